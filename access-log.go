@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/satori/go.uuid"
+)
+
+// rebindOrigin is the socket and request a rebind was offered to, so HTTP traffic can be correlated with them
+type rebindOrigin struct {
+	Socket  uuid.UUID
+	Request uuid.UUID
+	Mode    RebindMode
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size (and the implicit 200)
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the underlying writer
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the underlying writer, needed for the WebSocket
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// SetAccessLog sends the HTTP access log to its own logger instead of the main log (at info level)
+func (m *RebindManager) SetAccessLog(logger *logrus.Logger) {
+	m.accessLog = logger
+}
+
+// accessLogMiddleware logs every request a server handles, server is the address it's bound to
+func (m *RebindManager) accessLogMiddleware(server *Address, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		lw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, req)
+		fields := logrus.Fields{
+			"server":    server.String(),
+			"client":    req.RemoteAddr,
+			"method":    req.Method,
+			"host":      req.Host,
+			"path":      req.URL.Path,
+			"status":    lw.status,
+			"bytes":     lw.bytes,
+			"duration":  time.Since(start).Seconds(),
+			"userAgent": req.UserAgent(),
+		}
+		if ip := clientIP(req.Context()); ip != "" {
+			fields["client"] = ip
+		}
+		if id, _, ok := m.lookupRebind(req.Host); ok {
+			fields["rebind"] = id.String()
+			m.RebindsLock.RLock()
+			origin, exists := m.RebindOrigins[id]
+			m.RebindsLock.RUnlock()
+			if exists {
+				fields["socket"] = origin.Socket.String()
+				fields["request"] = origin.Request.String()
+			}
+		}
+		logger := m.accessLog
+		if logger == nil {
+			logger = log
+		}
+		logger.WithFields(fields).Info("HTTP request")
+	})
+}
@@ -12,10 +12,13 @@ import (
 // Address is a helper class for dealing with IPs.
 // It understands IPv4/IPv6, CNAMEs and mappings of internal/external IPs
 type Address struct {
-	Port       string // Port is the port in the pair (if specified)
-	Host       string // Host is the hostname of the address (ex. CNAMEs)
-	InternalIP net.IP // internal is the parsed ip address for internal use (binding/iptables)
-	ExternalIP net.IP // external is the parsed ip address for external use (dns)
+	Port       string     // Port is the port in the pair (if specified)
+	Host       string     // Host is the hostname of the address (ex. CNAMEs)
+	InternalIP net.IP     // internal is the parsed ip address for internal use (binding/iptables)
+	ExternalIP net.IP     // external is the parsed ip address for external use (dns)
+	Freebind   bool       // Freebind binds with IP_FREEBIND, used for addresses not configured on any interface
+	Ports      PortRanges // Ports the address may be bound to when used in the pool, nil for any
+	Tag        string     // The named pool the address belongs to when used in the pool, "" for the default
 }
 
 // NewAddress creates a *Address instance
@@ -109,5 +112,8 @@ func (a *Address) Clone() *Address {
 		Host:       a.Host,
 		InternalIP: a.InternalIP,
 		ExternalIP: a.ExternalIP,
+		Freebind:   a.Freebind,
+		Ports:      a.Ports,
+		Tag:        a.Tag,
 	}
 }
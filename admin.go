@@ -0,0 +1,166 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// The admin interface is a small JSON API for operators, it runs on its own listener and is never served to rebind targets
+
+// AdminPoolRequest is the body of requests that change the pool
+type AdminPoolRequest struct {
+	Address  string `json:"address"`  // The (internal) address to operate on
+	External string `json:"external"` // The external address when adding an address behind NAT (optional)
+	Ports    string `json:"ports"`    // The ports the address may be bound to when adding an address (optional, ex. "80,8000-9000")
+	Tag      string `json:"tag"`      // The named pool to add the address to (optional, ex. "dedicated")
+}
+
+// AdminPoolResponse is the body returned by requests that change the pool
+type AdminPoolResponse struct {
+	Removed bool `json:"removed,omitempty"` // Set when a removed address had no leases left and was dropped immediately
+}
+
+// ListenAdmin starts the operator interface on bind, shutting it down when the context is cancelled
+// An error is returned if bind can't be listened on
+func (m *RebindManager) ListenAdmin(ctx context.Context, wg *sync.WaitGroup, bind string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pool", m.AdminPoolHandler)
+	mux.HandleFunc("/pool/add", m.AdminPoolAddHandler)
+	mux.HandleFunc("/pool/drain", m.AdminPoolDrainHandler)
+	mux.HandleFunc("/pool/remove", m.AdminPoolRemoveHandler)
+	mux.HandleFunc("/servers", m.AdminServersHandler)
+	srv := &http.Server{
+		Addr:    bind,
+		Handler: mux,
+	}
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		return fmt.Errorf(`couldn't start the admin server on "%s": %v`, bind, err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		log.Infof(`Created admin server bound to "%s"`, bind)
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf(`Admin server bound to "%s" failed: %v`, bind, err)
+		}
+		log.Infof(`Closed admin server bound to "%s"`, bind)
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownHTTPServer(srv)
+	}()
+	return nil
+}
+
+// AdminPoolHandler reports the status of every address in the pool
+func (m *RebindManager) AdminPoolHandler(w http.ResponseWriter, req *http.Request) {
+	adminWriteJSON(w, m.pool.Status())
+}
+
+// AdminPoolAddHandler adds an address to the pool
+func (m *RebindManager) AdminPoolAddHandler(w http.ResponseWriter, req *http.Request) {
+	body, ok := adminReadPoolRequest(w, req)
+	if !ok {
+		return
+	}
+	addr := NewAddress(body.Address)
+	if addr == nil || addr.IP() == nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	if body.External != "" {
+		external := NewAddress(body.External)
+		if external == nil || external.IP() == nil {
+			http.Error(w, "invalid external address", http.StatusBadRequest)
+			return
+		}
+		addr.ExternalIP = external.IP()
+	}
+	if body.Ports != "" {
+		ports, err := ParsePortRanges(body.Ports)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr.Ports = ports
+	}
+	addr.Tag = body.Tag
+	if err := m.pool.Add(addr); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	adminWriteJSON(w, &AdminPoolResponse{})
+}
+
+// AdminPoolDrainHandler stops new leases on an address
+func (m *RebindManager) AdminPoolDrainHandler(w http.ResponseWriter, req *http.Request) {
+	body, ok := adminReadPoolRequest(w, req)
+	if !ok {
+		return
+	}
+	addr := NewAddress(body.Address)
+	if addr == nil || addr.IP() == nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	if err := m.pool.Drain(addr.IP()); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	adminWriteJSON(w, &AdminPoolResponse{})
+}
+
+// AdminPoolRemoveHandler removes an address from the pool once it has drained
+func (m *RebindManager) AdminPoolRemoveHandler(w http.ResponseWriter, req *http.Request) {
+	body, ok := adminReadPoolRequest(w, req)
+	if !ok {
+		return
+	}
+	addr := NewAddress(body.Address)
+	if addr == nil || addr.IP() == nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	removed, err := m.pool.Remove(addr.IP())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	adminWriteJSON(w, &AdminPoolResponse{Removed: removed})
+}
+
+// AdminServersHandler reports how many HTTP servers are running, both active and warm
+func (m *RebindManager) AdminServersHandler(w http.ResponseWriter, req *http.Request) {
+	adminWriteJSON(w, m.HTTPServerStats())
+}
+
+// adminReadPoolRequest parses the body of a POST request, writing an error response if it fails
+func adminReadPoolRequest(w http.ResponseWriter, req *http.Request) (body AdminPoolRequest, ok bool) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	return body, true
+}
+
+// adminWriteJSON writes v as the JSON response
+func adminWriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
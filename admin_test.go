@@ -0,0 +1,33 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestListenAdminReturnsBindErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	m := NewRebindManager("rebind.test", nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	// The port is taken, the error comes back instead of taking the process down
+	if err := m.ListenAdmin(ctx, &wg, l.Addr().String()); err == nil {
+		t.Fatal("expected an error listening on a port in use")
+	}
+	if err := m.ListenAdmin(ctx, &wg, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// The web assets are embedded in the binary so it works from any directory, each may be overridden by a file of the same name in an override directory
+// They're rendered with text/template, anything client controlled must go through the js (or html) escaping functions
+
+//go:embed www
+var embeddedAssets embed.FS
+
+// Paths the assets are served on
+const (
+	scriptPath   = "/v1.js"
+	framePath    = "/.well-known/rebind/v1.frame"
+	cachePath    = "/.well-known/rebind/v1.appcache"
+	pingPath     = "/.well-known/rebind/v1.ping"
+	navigatePath = "/.well-known/rebind/v1.navigate"
+)
+
+// assetContentTypes is the list of assets and the content type each is served with
+var assetContentTypes = map[string]string{
+	"rebind.js":      "application/javascript",
+	"frame.html":     "text/html; charset=utf-8",
+	"frame.appcache": "text/cache-manifest",
+	"navigate.html":  "text/html; charset=utf-8",
+}
+
+// AssetData is the data available to the asset templates
+type AssetData struct {
+	Base         string    // The base domain rebinds are served under
+	Host         string    // The host the asset was requested from (client controlled)
+	RebindID     uuid.UUID // The rebind the asset was requested for, empty outside of rebind hosts
+	PingInterval int64     // How often the frame pings to detect the rebind, in milliseconds
+	Protocol     string    // The WebSocket subprotocol (and version) clients ask for
+	ScriptPath   string
+	FramePath    string
+	CachePath    string
+	PingPath     string
+	NavigatePath string
+}
+
+// Assets holds the parsed asset templates
+type Assets struct {
+	templates map[string]*template.Template
+}
+
+// NewAssets parses the embedded assets, preferring files in overrideDir (if not empty)
+func NewAssets(overrideDir string) (*Assets, error) {
+	embedded, err := fs.Sub(embeddedAssets, "www")
+	if err != nil {
+		return nil, err
+	}
+	var override fs.FS
+	if overrideDir != "" {
+		if info, err := os.Stat(overrideDir); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf(`asset override "%s" is not a directory`, overrideDir)
+		}
+		override = os.DirFS(overrideDir)
+	}
+	a := Assets{
+		templates: make(map[string]*template.Template),
+	}
+	for name := range assetContentTypes {
+		source := "embedded"
+		raw, err := fs.ReadFile(embedded, name)
+		if override != nil {
+			if overridden, overrideErr := fs.ReadFile(override, name); overrideErr == nil {
+				raw, err, source = overridden, nil, overrideDir
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(name).Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf(`couldn't parse asset "%s" (%s): %v`, name, source, err)
+		}
+		log.Debugf(`Loaded asset "%s" (%s)`, name, source)
+		a.templates[name] = tmpl
+	}
+	return &a, nil
+}
+
+// Serve renders an asset to the response
+func (a *Assets) Serve(w http.ResponseWriter, name string, data *AssetData) {
+	var buf bytes.Buffer
+	if err := a.templates[name].Execute(&buf, data); err != nil {
+		log.Errorf(`Failed to render asset "%s": %v`, name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", assetContentTypes[name])
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+// assetData builds the template data for a request
+func (m *RebindManager) assetData(req *http.Request) *AssetData {
+	return &AssetData{
+		Base:         m.base,
+		Host:         req.Host,
+		RebindID:     rebindID(req.Context()),
+		PingInterval: int64(m.pingInterval / time.Millisecond),
+		Protocol:     webSocketProtocol,
+		ScriptPath:   scriptPath,
+		FramePath:    framePath,
+		CachePath:    cachePath,
+		PingPath:     pingPath,
+		NavigatePath: navigatePath,
+	}
+}
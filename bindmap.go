@@ -0,0 +1,148 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BindMap maps internal IPs to the external IPs they're reachable on (ex. a 1:1 NAT), either a single IP or a whole range
+// Addresses in a range keep their offset, so 10.0.0.0/28=203.0.113.16/28 maps 10.0.0.5 to 203.0.113.21
+type BindMap struct {
+	Internal *net.IPNet
+	External *net.IPNet
+}
+
+// ParseBindMap parses a mapping in the form "internal=external" where both sides are IPs (10.0.0.5=203.0.113.5)
+// or prefixes of the same size (10.0.0.0/28=203.0.113.16/28)
+// The legacy "internal/external" form is still accepted for single IPs
+func ParseBindMap(raw string) (*BindMap, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 {
+		// Fall back to the legacy form, which can't be told apart from CIDR notation unless both sides are IPs
+		parts = strings.SplitN(raw, "/", 2)
+		if len(parts) != 2 || net.ParseIP(parts[0]) == nil || net.ParseIP(parts[1]) == nil {
+			return nil, fmt.Errorf(`invalid bind-map "%s", expected internal=external (ex. 10.0.0.5=203.0.113.5 or 10.0.0.0/28=203.0.113.16/28)`, raw)
+		}
+	}
+	internal, err := parseBindMapNet(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf(`invalid bind-map "%s", bad internal side: %v`, raw, err)
+	}
+	external, err := parseBindMapNet(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf(`invalid bind-map "%s", bad external side: %v`, raw, err)
+	}
+	if (internal.IP.To4() == nil) != (external.IP.To4() == nil) {
+		return nil, fmt.Errorf(`invalid bind-map "%s", both sides must be the same address family`, raw)
+	}
+	internalOnes, _ := internal.Mask.Size()
+	externalOnes, _ := external.Mask.Size()
+	if internalOnes != externalOnes {
+		return nil, fmt.Errorf(`invalid bind-map "%s", both sides must be the same size (/%d and /%d)`, raw, internalOnes, externalOnes)
+	}
+	return &BindMap{
+		Internal: internal,
+		External: external,
+	}, nil
+}
+
+// parseBindMapNet parses one side of a bind-map, a single IP is treated as a /32 (or /128)
+func parseBindMapNet(raw string) (*net.IPNet, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		ip, ipNet, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !ip.Equal(ipNet.IP) {
+			return nil, fmt.Errorf(`"%s" has host bits set, did you mean %s?`, raw, ipNet)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return nil, fmt.Errorf(`"%s" is not an IP or prefix`, raw)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Map returns the external IP for an internal IP, or nil if the IP isn't covered by the mapping
+func (m *BindMap) Map(ip net.IP) net.IP {
+	if !m.Internal.Contains(ip) {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil && m.Internal.IP.To4() != nil {
+		ip = ip4
+	}
+	network := m.External.IP
+	if len(ip) == net.IPv4len {
+		network = network.To4()
+	}
+	external := make(net.IP, len(network))
+	for idx := range external {
+		external[idx] = network[idx] | (ip[idx] &^ m.Internal.Mask[idx])
+	}
+	return external
+}
+
+// Covers returns true if every IP in the prefix is covered by the mapping
+func (m *BindMap) Covers(prefix *net.IPNet) bool {
+	internalOnes, internalBits := m.Internal.Mask.Size()
+	prefixOnes, prefixBits := prefix.Mask.Size()
+	return internalBits == prefixBits && internalOnes <= prefixOnes && m.Internal.Contains(prefix.IP)
+}
+
+// ApplyBindMaps sets the external IPs of the pool addresses and prefixes covered by the mappings
+// Every mapping must cover something and nothing may be covered twice, a prefix must fit entirely within a single mapping
+func ApplyBindMaps(maps []*BindMap, pool []*Address, prefixes []*PoolPrefix) error {
+	addrMappedBy := make(map[*Address]*BindMap)
+	prefixMappedBy := make(map[*PoolPrefix]*BindMap)
+	for _, bindMap := range maps {
+		matched := false
+		for _, addr := range pool {
+			external := bindMap.Map(addr.IP())
+			if external == nil {
+				continue
+			}
+			if other, ok := addrMappedBy[addr]; ok {
+				return fmt.Errorf("pool IP %s is covered by both bind-maps %s and %s", addr.IP(), other, bindMap)
+			}
+			addrMappedBy[addr] = bindMap
+			addr.ExternalIP = external
+			matched = true
+		}
+		for _, prefix := range prefixes {
+			if !bindMap.Covers(prefix.Net) {
+				// Only part of the prefix would be mapped, the rest would be synthesized with their internal IP as external
+				if bindMap.Internal.Contains(prefix.Net.IP) || prefix.Net.Contains(bindMap.Internal.IP) {
+					return fmt.Errorf("pool prefix %s is only partially covered by bind-map %s", prefix, bindMap)
+				}
+				continue
+			}
+			if other, ok := prefixMappedBy[prefix]; ok {
+				return fmt.Errorf("pool prefix %s is covered by both bind-maps %s and %s", prefix, other, bindMap)
+			}
+			prefixMappedBy[prefix] = bindMap
+			prefix.BindMap = bindMap
+			matched = true
+		}
+		if !matched {
+			return fmt.Errorf("bind-map %s doesn't match any IP or prefix in the pool", bindMap)
+		}
+	}
+	return nil
+}
+
+// String formats the mapping the same way it's parsed
+func (m *BindMap) String() string {
+	return fmt.Sprintf("%s=%s", m.Internal, m.External)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseBindMap(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // "" if parsing should fail
+	}{
+		{"10.0.0.5=203.0.113.5", "10.0.0.5/32=203.0.113.5/32"},
+		{"10.0.0.0/28=203.0.113.16/28", "10.0.0.0/28=203.0.113.16/28"},
+		{" 10.0.0.5 = 203.0.113.5 ", "10.0.0.5/32=203.0.113.5/32"},
+		{"2001:db8::/64=2001:db8:1::/64", "2001:db8::/64=2001:db8:1::/64"},
+		{"10.0.0.5/203.0.113.5", "10.0.0.5/32=203.0.113.5/32"}, // Legacy form
+		{"", ""},
+		{"=", ""},
+		{"10.0.0.5", ""},
+		{"10.0.0.5=", ""},
+		{"=203.0.113.5", ""},
+		{"10.0.0.5=nope", ""},
+		{"10.0.0.0/24", ""},                 // CIDR isn't the legacy form
+		{"10.0.0.5/28=203.0.113.16/28", ""}, // Host bits set
+		{"10.0.0.0/28=203.0.113.0/24", ""},  // Different sizes
+		{"10.0.0.5=2001:db8::5", ""},        // Mixed families
+		{"2001:db8::/64=10.0.0.0/24", ""},
+	}
+	for _, test := range tests {
+		bindMap, err := ParseBindMap(test.raw)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.raw, bindMap)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.raw, err)
+		} else if bindMap.String() != test.want {
+			t.Errorf("%q: expected %s, got %s", test.raw, test.want, bindMap)
+		}
+	}
+}
+
+func TestBindMapMap(t *testing.T) {
+	tests := []struct {
+		bindMap string
+		ip      string
+		want    string // "" if the IP isn't covered
+	}{
+		{"10.0.0.5=203.0.113.5", "10.0.0.5", "203.0.113.5"},
+		{"10.0.0.5=203.0.113.5", "10.0.0.6", ""},
+		{"10.0.0.0/28=203.0.113.16/28", "10.0.0.5", "203.0.113.21"},
+		{"10.0.0.0/28=203.0.113.16/28", "10.0.0.16", ""},
+		{"2001:db8::/64=2001:db8:1::/64", "2001:db8::5", "2001:db8:1::5"},
+		{"10.0.0.0/28=203.0.113.16/28", "2001:db8::5", ""}, // Mixed families never match
+		{"2001:db8::/64=2001:db8:1::/64", "10.0.0.5", ""},
+	}
+	for _, test := range tests {
+		bindMap, err := ParseBindMap(test.bindMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		external := bindMap.Map(net.ParseIP(test.ip))
+		if test.want == "" {
+			if external != nil {
+				t.Errorf("%s: expected %s not to be mapped, got %s", test.bindMap, test.ip, external)
+			}
+		} else if !external.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: expected %s to map to %s, got %s", test.bindMap, test.ip, test.want, external)
+		}
+	}
+}
+
+func TestApplyBindMaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		maps     []string
+		pool     []string
+		prefixes []string
+		external []string // The external IP of each pool address, nil if applying should fail
+	}{
+		{"empty", nil, []string{"10.0.0.5"}, nil, []string{"10.0.0.5"}},
+		{"single", []string{"10.0.0.5=203.0.113.5"}, []string{"10.0.0.5", "10.0.0.6"}, nil, []string{"203.0.113.5", "10.0.0.6"}},
+		{"range", []string{"10.0.0.0/28=203.0.113.16/28"}, []string{"10.0.0.5", "10.0.0.6"}, nil, []string{"203.0.113.21", "203.0.113.22"}},
+		{"mixed families", []string{"10.0.0.0/28=203.0.113.16/28", "2001:db8::/64=2001:db8:1::/64"}, []string{"10.0.0.5", "[2001:db8::5]"}, nil, []string{"203.0.113.21", "2001:db8:1::5"}},
+		{"prefix", []string{"10.0.0.0/24=203.0.113.0/24"}, nil, []string{"10.0.0.0/28"}, []string{}},
+		{"duplicate keys", []string{"10.0.0.5=203.0.113.5", "10.0.0.5=203.0.113.6"}, []string{"10.0.0.5"}, nil, nil},
+		{"overlapping ranges", []string{"10.0.0.0/28=203.0.113.16/28", "10.0.0.5=203.0.113.5"}, []string{"10.0.0.5"}, nil, nil},
+		{"duplicate prefix", []string{"10.0.0.0/24=203.0.113.0/24", "10.0.0.0/28=198.51.100.0/28"}, nil, []string{"10.0.0.0/28"}, nil},
+		{"partial prefix", []string{"10.0.0.0/28=203.0.113.16/28"}, nil, []string{"10.0.0.0/24"}, nil},
+		{"unmatched", []string{"10.0.1.5=203.0.113.5"}, []string{"10.0.0.5"}, nil, nil},
+	}
+	for _, test := range tests {
+		var maps []*BindMap
+		for _, raw := range test.maps {
+			bindMap, err := ParseBindMap(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			maps = append(maps, bindMap)
+		}
+		var pool []*Address
+		for _, raw := range test.pool {
+			pool = append(pool, NewAddress(raw))
+		}
+		var prefixes []*PoolPrefix
+		for _, raw := range test.prefixes {
+			prefixes = append(prefixes, NewPoolPrefix(raw, false))
+		}
+		err := ApplyBindMaps(maps, pool, prefixes)
+		if test.external == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		for idx, addr := range pool {
+			if !addr.ExternalIP.Equal(net.ParseIP(test.external[idx])) {
+				t.Errorf("%s: expected %s to map to %s, got %s", test.name, addr.IP(), test.external[idx], addr.ExternalIP)
+			}
+		}
+		// Synthesized addresses are mapped at the same offset
+		for _, prefix := range prefixes {
+			addr := prefix.Synthesize()
+			if want := prefix.BindMap.Map(addr.IP()); want == nil || !addr.ExternalIP.Equal(want) || addr.ExternalIP.Equal(addr.IP()) {
+				t.Errorf("%s: expected %s synthesized from %s to be mapped, got %s", test.name, addr.IP(), prefix, addr.ExternalIP)
+			}
+		}
+	}
+}
@@ -7,10 +7,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -26,15 +32,70 @@ type DNSOptions struct {
 	Bind string `long:"dns-bind" description:"Address to bind the DNS listeners to" required:"true"`
 }
 type HTTPOptions struct {
-	Bind    []string `long:"http-bind" description:"Address(es) to bind the main HTTP listener to" required:"true"`
-	Pool    []string `long:"http-pool" description:"The pool of IP addresses to use for HTTP requests" required:"true"`
-	BindMap []string `long:"http-bind-map" description:"A mapping of internal->external IPs to use when binding to addresses"`
+	Bind     []string `long:"http-bind" description:"Address(es) to bind the main HTTP listener to" required:"true"`
+	Pool     []string `long:"http-pool" description:"The pool of IP addresses or CIDR prefixes to use for HTTP requests" required:"true"`
+	BindMap  []string `long:"http-bind-map" description:"A mapping of internal=external IPs or same sized ranges to use when binding to addresses (10.0.0.5=203.0.113.5 or 10.0.0.0/28=203.0.113.16/28)"`
+	Freebind bool     `long:"http-pool-freebind" description:"Bind addresses synthesized from pool prefixes with IP_FREEBIND instead of relying on an AnyIP local route"`
+	Ports    []string `long:"http-pool-ports" description:"Ports pool addresses may be bound to, either for every address (80,8000-9000) or a single address/prefix (10.0.0.1=80,8000-9000)"`
+	Tags     []string `long:"http-pool-tag" description:"Move a pool address/prefix into a named pool (10.0.0.1=dedicated), the multi-record method prefers the \"dedicated\" pool and the others only use untagged addresses"`
+	// Web assets
+	AssetsDir    string        `long:"http-assets-dir" description:"Directory of web assets (rebind.js, frame.html, frame.appcache) overriding the embedded ones"`
+	PingInterval time.Duration `long:"http-frame-ping-interval" default:"2s" description:"How often rebind frames ping to detect the rebind"`
+	// Connections
+	IdleTimeout time.Duration `long:"http-idle-timeout" default:"5s" description:"Close connections to rebind servers that wait longer than this for a request (0 disables)"`
+	// Single listener mode
+	Intercept     string   `long:"http-intercept" choice:"tproxy" choice:"redirect" description:"Serve every pool address and port from the intercept listener(s) that firewall rules steer traffic to, instead of binding a server for each (linux only)"`
+	InterceptBind []string `long:"http-intercept-bind" description:"Address(es) to bind the intercept listener to (ex. 0.0.0.0:8099 and [::]:8099)"`
+	// Warm servers
+	WarmPorts    []string      `long:"http-warm-ports" description:"Keep HTTP servers on these ports (80,8080) open after their last rebind instead of closing them right away"`
+	WarmIdle     time.Duration `long:"http-warm-idle" default:"1m" description:"How long warm HTTP servers stay open without a rebind (0 keeps them until shutdown)"`
+	WarmPrestart bool          `long:"http-warm-prestart" description:"Start a warm HTTP server on every pool address for each of the warm ports at boot"`
+	AccessLog    string        `long:"http-access-log" description:"Write the HTTP access log as JSON lines to this file (- for stdout) instead of the main log at -vv"`
+	// Health checks
+	HealthInterval    time.Duration `long:"http-pool-health-interval" default:"30s" description:"How often pool addresses are health checked (0 only checks at startup)"`
+	HealthSelfConnect bool          `long:"http-pool-health-self-connect" description:"Also health check pool addresses by connecting to them through their external IP"`
+	// Client affinity
+	AffinitySpread   int  `long:"http-pool-affinity-spread" default:"1" description:"Number of pool addresses the rebinds of a single client are spread across (0 disables affinity)"`
+	AffinityBySocket bool `long:"http-pool-affinity-by-socket" description:"Group clients by WebSocket connection instead of by client IP for affinity"`
+	// Pool policy
+	Policy string `long:"http-pool-policy" choice:"random" choice:"least-leased" choice:"round-robin" choice:"sticky" default:"least-leased" description:"How rebind methods that don't declare their own policy pick between eligible pool addresses"`
+	// External IP discovery
+	Discovery         string        `long:"http-pool-discovery" choice:"metadata" choice:"stun" description:"Discover the external IP of pool addresses instead of using --http-bind-map"`
+	DiscoveryURL      string        `long:"http-pool-discovery-url" description:"Metadata URL returning the external IP, {internal} is replaced with the internal IP"`
+	DiscoverySTUN     string        `long:"http-pool-discovery-stun-server" default:"stun.l.google.com:19302" description:"STUN server used for discovery"`
+	DiscoveryInterval time.Duration `long:"http-pool-discovery-interval" default:"5m" description:"How often discovered mappings are refreshed (0 only discovers at startup)"`
+}
+type TLSOptions struct {
+	Bind    []string `long:"https-bind" description:"Address(es) to bind HTTPS listeners for the loader script and WebSocket to"`
+	Cert    string   `long:"tls-cert" description:"Certificate (PEM) for the HTTPS listeners"`
+	Key     string   `long:"tls-key" description:"Private key (PEM) for --tls-cert"`
+	CertDir string   `long:"tls-cert-dir" description:"Directory of certificates (name.crt with name.key) for the HTTPS listeners, selected by SNI"`
+}
+type PayloadOptions struct {
+	Dir      string   `long:"payload-dir" description:"Directory of payloads (test pages, scripts) served under /payloads/ on the main binds, files ending in .tmpl are rendered as templates"`
+	Named    []string `long:"payload" description:"A single named payload served under /payloads/ (landing=page.html)"`
+	Types    []string `long:"payload-type" description:"Content type of a payload when it can't be guessed from its name (landing=text/html)"`
+	Index    string   `long:"payload-index" description:"Payload served as the landing page of the main binds"`
+	Campaign string   `long:"payload-campaign" description:"Campaign ID available to payload templates"`
+}
+type ProxyOptions struct {
+	ProtocolFrom  []string `long:"proxy-protocol-from" description:"IPs or CIDR prefixes of load balancers sending a PROXY protocol (v1 or v2) header to the HTTP and DNS over TCP listeners"`
+	Trusted       []string `long:"trusted-proxy" description:"IPs or CIDR prefixes of proxies whose forwarding header (see --trusted-proxy-header) is believed"`
+	TrustedHeader string   `long:"trusted-proxy-header" choice:"x-forwarded-for" choice:"forwarded" default:"x-forwarded-for" description:"The forwarding header the trusted proxies set (with x-forwarded-for the scheme is read from X-Forwarded-Proto), the other one is never read since clients can send it themselves"`
+}
+type AdminOptions struct {
+	Bind string `long:"admin-bind" description:"Address to bind the operator interface to (disabled if not set)"`
 }
 type Options struct {
-	Base    string      `short:"b" long:"base-uri" description:"The base URI to serve files from" required:"true"`
-	Verbose []bool      `short:"v" long:"verbose" description:"Verbose output"`
-	DNS     DNSOptions  `group:"DNS Options"`
-	HTTP    HTTPOptions `group:"HTTP Options"`
+	Base    string         `short:"b" long:"base-uri" description:"The base URI to serve files from" required:"true"`
+	Verbose []bool         `short:"v" long:"verbose" description:"Verbose output"`
+	Drain   time.Duration  `long:"drain-timeout" default:"10s" description:"How long connected clients get to finish their rebinds after SIGINT/SIGTERM before they're torn down"`
+	DNS     DNSOptions     `group:"DNS Options"`
+	HTTP    HTTPOptions    `group:"HTTP Options"`
+	TLS     TLSOptions     `group:"TLS Options"`
+	Payload PayloadOptions `group:"Payload Options"`
+	Proxy   ProxyOptions   `group:"Proxy Options"`
+	Admin   AdminOptions   `group:"Admin Options"`
 }
 
 var opts Options
@@ -78,55 +139,281 @@ func main() {
 		binds[idx] = addr
 	}
 
-	// Cast the pool ips and make sure they're valid
-	pool := make([]*Address, len(opts.HTTP.Pool))
-	for idx, rawIP := range opts.HTTP.Pool {
+	// Cast the HTTPS bind addresses and load their certificates
+	tlsBinds := make([]*Address, len(opts.TLS.Bind))
+	for idx, rawIP := range opts.TLS.Bind {
+		addr := NewAddress(rawIP)
+		if addr == nil {
+			log.Fatalf("Couldn't parse HTTPS Bind address: %s", rawIP)
+		}
+		tlsBinds[idx] = addr
+	}
+	var tlsConfig *tls.Config
+	if len(tlsBinds) > 0 {
+		var err error
+		if tlsConfig, err = LoadTLSConfig(opts.TLS.Cert, opts.TLS.Key, opts.TLS.CertDir); err != nil {
+			log.Fatalf("Couldn't load TLS certificates: %v", err)
+		}
+	}
+
+	// Cast the pool ips and prefixes and make sure they're valid
+	var pool []*Address
+	var prefixes []*PoolPrefix
+	for _, rawIP := range opts.HTTP.Pool {
+		if strings.Contains(rawIP, "/") {
+			prefix := NewPoolPrefix(rawIP, opts.HTTP.Freebind)
+			if prefix == nil {
+				log.Fatalf("Couldn't parse HTTP pool prefix: %s", rawIP)
+			}
+			prefixes = append(prefixes, prefix)
+			continue
+		}
 		addr := NewAddress(rawIP)
 		if addr == nil {
 			log.Fatalf("Couldn't parse HTTP pool IP: %s", rawIP)
 		}
-		pool[idx] = addr
+		pool = append(pool, addr)
 	}
 
-	// If we were provided bind-map, update the pool IPs with their internal/external bindings
-	for _, bindMap := range opts.HTTP.BindMap {
-		rawIPs := strings.SplitN(bindMap, "/", 2)
-		addrInternal := NewAddress(rawIPs[0])
-		if addrInternal == nil {
-			log.Fatalf("Couldn't parse HTTP bind-map internal IP: %s", addrInternal)
+	// If we were provided bind-map, update the pool IPs and prefixes with their internal/external bindings
+	bindMaps := make([]*BindMap, len(opts.HTTP.BindMap))
+	for idx, rawMap := range opts.HTTP.BindMap {
+		bindMap, err := ParseBindMap(rawMap)
+		if err != nil {
+			log.Fatalf("Couldn't parse HTTP bind-map: %v", err)
+		}
+		bindMaps[idx] = bindMap
+	}
+	if err := ApplyBindMaps(bindMaps, pool, prefixes); err != nil {
+		log.Fatalf("Couldn't apply HTTP bind-map: %v", err)
+	}
+
+	// If we were provided pool ports, restrict the pool IPs and prefixes to them
+	for _, rawPorts := range opts.HTTP.Ports {
+		target := ""
+		if parts := strings.SplitN(rawPorts, "=", 2); len(parts) == 2 {
+			target, rawPorts = parts[0], parts[1]
+		}
+		ports, err := ParsePortRanges(rawPorts)
+		if err != nil {
+			log.Fatalf("Couldn't parse HTTP pool ports: %v", err)
 		}
-		addrExternal := NewAddress(rawIPs[1])
-		if addrExternal == nil {
-			log.Fatalf("Couldn't parse HTTP bind-map external IP: %s", addrExternal)
+		matched := false
+		for _, addr := range pool {
+			if target == "" || addr.IP().Equal(net.ParseIP(target)) {
+				addr.Ports = ports
+				matched = true
+			}
+		}
+		for _, prefix := range prefixes {
+			if target == "" || prefix.String() == target {
+				prefix.Ports = ports
+				matched = true
+			}
+		}
+		if !matched {
+			log.Fatalf("HTTP pool ports target is not in the pool: %s", target)
 		}
-		// Loop over each addr in the pool until we find the match
+	}
+
+	// If we were provided pool tags, move the pool IPs and prefixes into their named pools
+	for _, rawTag := range opts.HTTP.Tags {
+		parts := strings.SplitN(rawTag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Couldn't parse HTTP pool tag (expected address=tag): %s", rawTag)
+		}
+		target, tag := parts[0], parts[1]
+		matched := false
 		for _, addr := range pool {
-			if addr.IP().Equal(addrInternal.IP()) {
-				addr.ExternalIP = addrExternal.IP()
+			if addr.IP().Equal(net.ParseIP(target)) {
+				addr.Tag = tag
+				matched = true
+			}
+		}
+		for _, prefix := range prefixes {
+			if prefix.String() == target {
+				prefix.Tag = tag
+				matched = true
 			}
 		}
+		if !matched {
+			log.Fatalf("HTTP pool tag target is not in the pool: %s", target)
+		}
 	}
 
 	// Create a base context for this main thread
 	ctx, triggerShutdown := context.WithCancel(context.Background())
 
 	// Create a new rebind manager with the provided options
-	mgr := NewRebindManager(opts.Base, pool)
+	mgr := NewRebindManager(opts.Base, pool, prefixes)
+	mgr.SetAffinity(opts.HTTP.AffinitySpread, opts.HTTP.AffinityBySocket)
+	if opts.HTTP.Policy != "" {
+		policy, err := ParsePoolPolicy(opts.HTTP.Policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mgr.SetPoolPolicy(policy)
+	}
+	if len(opts.Proxy.ProtocolFrom) > 0 || len(opts.Proxy.Trusted) > 0 {
+		proxies := TrustedProxies{
+			Header: http.CanonicalHeaderKey(opts.Proxy.TrustedHeader),
+		}
+		var err error
+		if proxies.Protocol, err = ParseIPNets(opts.Proxy.ProtocolFrom); err != nil {
+			log.Fatalf("Couldn't parse --proxy-protocol-from: %v", err)
+		}
+		if proxies.Forwarded, err = ParseIPNets(opts.Proxy.Trusted); err != nil {
+			log.Fatalf("Couldn't parse --trusted-proxy: %v", err)
+		}
+		mgr.SetTrustedProxies(&proxies)
+	}
+	assets, err := NewAssets(opts.HTTP.AssetsDir)
+	if err != nil {
+		log.Fatalf("Couldn't load web assets: %v", err)
+	}
+	mgr.SetAssets(assets, opts.HTTP.PingInterval)
+	mgr.MonitorConnections(ctx, opts.HTTP.IdleTimeout)
+	if opts.HTTP.AccessLog != "" {
+		accessLog := logrus.New()
+		accessLog.Formatter = &logrus.JSONFormatter{}
+		if opts.HTTP.AccessLog != "-" {
+			file, err := os.OpenFile(opts.HTTP.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatalf("Couldn't open the HTTP access log: %v", err)
+			}
+			defer file.Close()
+			accessLog.Out = file
+		} else {
+			accessLog.Out = os.Stdout
+		}
+		mgr.SetAccessLog(accessLog)
+	}
+
+	// Load the payloads
+	payloads := NewPayloads(opts.Payload.Campaign)
+	if opts.Payload.Dir != "" {
+		if err := payloads.AddDir(opts.Payload.Dir); err != nil {
+			log.Fatalf("Couldn't load payloads: %v", err)
+		}
+	}
+	for _, rawPayload := range opts.Payload.Named {
+		parts := strings.SplitN(rawPayload, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Couldn't parse payload (expected name=file): %s", rawPayload)
+		}
+		if err := payloads.Add(parts[0], parts[1], ""); err != nil {
+			log.Fatalf("Couldn't load payload: %v", err)
+		}
+	}
+	for _, rawType := range opts.Payload.Types {
+		parts := strings.SplitN(rawType, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Couldn't parse payload type (expected name=type): %s", rawType)
+		}
+		if err := payloads.SetContentType(parts[0], parts[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.Payload.Index != "" {
+		if err := payloads.SetIndex(opts.Payload.Index); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mgr.SetPayloads(payloads)
+
+	// Discover the external IPs of the pool before anything is leased from it
+	switch opts.HTTP.Discovery {
+	case "metadata":
+		if opts.HTTP.DiscoveryURL == "" {
+			log.Fatal("--http-pool-discovery-url is required for metadata discovery")
+		}
+		mgr.MonitorPoolMappings(ctx, &MetadataDiscovery{
+			URL:    opts.HTTP.DiscoveryURL,
+			Client: &http.Client{Timeout: 5 * time.Second},
+		}, opts.HTTP.DiscoveryInterval)
+	case "stun":
+		mgr.MonitorPoolMappings(ctx, &STUNDiscovery{
+			Server:  opts.HTTP.DiscoverySTUN,
+			Timeout: 5 * time.Second,
+		}, opts.HTTP.DiscoveryInterval)
+	}
+
+	// Check the pool before anything is leased from it, intercepted addresses are never bound so there's nothing to check
+	if opts.HTTP.Intercept == "" {
+		mgr.MonitorPoolHealth(ctx, &PoolHealthCheck{
+			SelfConnect: opts.HTTP.HealthSelfConnect,
+			Timeout:     2 * time.Second,
+		}, opts.HTTP.HealthInterval)
+	}
+
+	// Start the intercept listeners before any server is created so they're all registered with them
+	interceptWg := new(sync.WaitGroup)
+	if opts.HTTP.Intercept != "" {
+		if len(opts.HTTP.InterceptBind) == 0 {
+			log.Fatal("--http-intercept-bind is required with --http-intercept")
+		}
+		mode, err := ParseInterceptMode(opts.HTTP.Intercept)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mgr.Intercept(ctx, interceptWg, opts.HTTP.InterceptBind, mode); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Keep servers on common ports warm between rebinds if requested
+	if len(opts.HTTP.WarmPorts) > 0 {
+		var warmPorts []string
+		for _, rawPorts := range opts.HTTP.WarmPorts {
+			for _, port := range strings.Split(rawPorts, ",") {
+				if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+					log.Fatalf("Couldn't parse warm port: %s", port)
+				}
+				warmPorts = append(warmPorts, port)
+			}
+		}
+		mgr.WarmHTTPServers(ctx, warmPorts, opts.HTTP.WarmIdle, opts.HTTP.WarmPrestart)
+	}
 
 	// Begin listening
 	listenersWg, err := mgr.Listen(ctx, opts.DNS.Bind, binds)
 	if err != nil {
-		log.Error(err)
+		log.Fatal(err)
+	}
+
+	// Start the HTTPS listeners if requested
+	if tlsConfig != nil {
+		if err := mgr.ListenTLS(ctx, listenersWg, tlsBinds, tlsConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Start the operator interface if requested
+	if opts.Admin.Bind != "" {
+		if err := mgr.ListenAdmin(ctx, listenersWg, opts.Admin.Bind); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Listen for a sigstop
+	// Listen for a SIGINT/SIGTERM
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	for range c {
-		// Cancel the main context, this should trigger a shutdown
-		triggerShutdown()
-		// Wait for all listening servers to cleanup gracefully before exiting
-		listenersWg.Wait()
-		break
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	log.Warnf("Got %s, shutting down once connected clients drain (up to %s)", sig, opts.Drain)
+	// Give connected clients a chance to finish, a second signal skips the wait
+	drained := make(chan struct{})
+	go func() {
+		mgr.Drain(opts.Drain)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case sig := <-c:
+		log.Warnf("Got %s again, shutting down now", sig)
 	}
+	// Cancel the main context, this should trigger a shutdown
+	triggerShutdown()
+	// Wait for all listening servers to cleanup gracefully before exiting
+	listenersWg.Wait()
+	interceptWg.Wait()
 }
@@ -17,6 +17,10 @@ import (
 const (
 	socketIDKey  string = "socketID"
 	requestIDKey string = "requestID"
+	clientIPKey  string = "clientIP"
+	rebindIDKey  string = "rebindID"
+	connKey      string = "conn"
+	mainBindKey  string = "mainBind"
 )
 
 // socketID retrieves the socket ID from the provided context
@@ -36,3 +40,30 @@ func requestID(ctx context.Context) uuid.UUID {
 	}
 	return val.(uuid.UUID)
 }
+
+// clientIP retrieves the client IP from the provided context
+func clientIP(ctx context.Context) string {
+	val := ctx.Value(clientIPKey)
+	if val == nil {
+		return ""
+	}
+	return val.(string)
+}
+
+// rebindID retrieves the ID of the rebind a HTTP request was made for from the provided context
+func rebindID(ctx context.Context) uuid.UUID {
+	val := ctx.Value(rebindIDKey)
+	if val == nil {
+		return uuid.UUID{}
+	}
+	return val.(uuid.UUID)
+}
+
+// mainBind retrieves the configured main bind a HTTP request was made to from the provided context, nil for the other servers
+func mainBind(ctx context.Context) *Address {
+	val := ctx.Value(mainBindKey)
+	if val == nil {
+		return nil
+	}
+	return val.(*Address)
+}
@@ -6,7 +6,7 @@
 package main
 
 import (
-	"github.com/satori/go.uuid"
+	"net"
 
 	"github.com/miekg/dns"
 )
@@ -31,22 +31,9 @@ func (m *RebindManager) ServeDefaultDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 // ServeDNS handles DNS requests, either returning the matching
 func (m *RebindManager) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	log.Debugf("Got DNS Request: %s", req.Question[0].String())
-	// Extract out the UUID
-	matches := SubdomainRegex.FindStringSubmatch(req.Question[0].Name)
-	if len(matches) != 2 {
-		m.ServeDefaultDNS(w, req)
-		return
-	}
-	u, err := uuid.FromString(matches[1])
-	if err != nil {
-		m.ServeDefaultDNS(w, req)
-		return
-	}
-	// Check if we have a known rebind method for it
-	m.RebindsLock.RLock()
-	rebind, exists := m.Rebinds[u]
-	m.RebindsLock.RUnlock()
+	log.Debugf("Got DNS Request from %s: %s", w.RemoteAddr(), req.Question[0].String())
+	// Check if we have a known rebind method for the UUID
+	id, rebind, exists := m.lookupRebind(req.Question[0].Name)
 	if !exists {
 		m.ServeDefaultDNS(w, req)
 		return
@@ -70,12 +57,12 @@ func (m *RebindManager) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		case dns.TypeA:
 			r.Answer[idx] = &dns.A{
 				Hdr: hdr,
-				A:   answer.Address.IP(),
+				A:   answer.Address.ExternalIP,
 			}
 		case dns.TypeAAAA:
 			r.Answer[idx] = &dns.AAAA{
 				Hdr:  hdr,
-				AAAA: answer.Address.IP(),
+				AAAA: answer.Address.ExternalIP,
 			}
 		case dns.TypeCNAME:
 			r.Answer[idx] = &dns.CNAME{
@@ -84,9 +71,17 @@ func (m *RebindManager) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			}
 		}
 	}
+	// Connections left over from before the answers changed must not keep serving the rebind
+	if qType := req.Question[0].Qtype; qType == dns.TypeA || qType == dns.TypeAAAA {
+		current := make([]net.IP, len(answers))
+		for idx, answer := range answers {
+			current[idx] = answer.Address.InternalIP
+		}
+		m.conns.reapRebind(id, qType == dns.TypeAAAA, current)
+	}
 	//log.Debugf("Answered DNS Request: %s", r)
 	// Send the actual DNS response
-	err = w.WriteMsg(r)
+	err := w.WriteMsg(r)
 	if err != nil {
 		log.Error(err)
 	}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Rebinding only works if the browser opens a new connection (and so does a new DNS lookup) for each request
+// Keep-alives are disabled on rebind servers, on top of that each method picks how connections are ended and stale connections are reaped:
+// - Connections for a rebind are closed as soon as its DNS answers stop pointing at the server they're connected to
+// - Connections that sit idle (ex. browser preconnects) are closed after the idle timeout
+
+// ConnTermination is how a rebind server ends a connection once it has answered a request
+type ConnTermination int
+
+const (
+	ConnTerminationClose    ConnTermination = iota // Send "Connection: close" and close normally
+	ConnTerminationGraceful                        // Also wait for the client to close its side so it can't hold on to the connection
+	ConnTerminationReset                           // Abort with a RST (SO_LINGER=0) so the client can't reuse the connection at all
+)
+
+// connGracefulTimeout is how long a graceful close waits for the client to close its side
+const connGracefulTimeout = 2 * time.Second
+
+// String is used for logging
+func (t ConnTermination) String() string {
+	switch t {
+	case ConnTerminationGraceful:
+		return "graceful"
+	case ConnTerminationReset:
+		return "reset"
+	default:
+		return "close"
+	}
+}
+
+// trackedConn is a connection accepted by a rebind server
+type trackedConn struct {
+	net.Conn
+	mutex       sync.Mutex
+	termination ConnTermination
+	rebind      uuid.UUID // The rebind the last request was for, empty until a request arrives
+	state       http.ConnState
+	since       time.Time // When the connection entered its state
+	closeOnce   sync.Once
+	closeErr    error
+	local       net.Addr // The original destination of intercepted connections, nil to use the socket's
+}
+
+// LocalAddr returns the address the client connected to
+func (c *trackedConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// tag records the rebind a request on the connection is for and how the connection must end
+func (c *trackedConn) tag(id uuid.UUID, termination ConnTermination) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rebind = id
+	c.termination = termination
+}
+
+// CloseWrite is called by net/http before closing, a reset aborts right away instead
+func (c *trackedConn) CloseWrite() error {
+	c.mutex.Lock()
+	termination := c.termination
+	c.mutex.Unlock()
+	if termination == ConnTerminationReset {
+		return c.Close()
+	}
+	if tcp, ok := tcpConn(c.Conn); ok {
+		return tcp.CloseWrite()
+	}
+	return nil
+}
+
+// Close ends the connection the way it was tagged to, it never blocks (graceful closes finish in the background)
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		termination := c.termination
+		c.mutex.Unlock()
+		tcp, isTCP := tcpConn(c.Conn)
+		switch {
+		case termination == ConnTerminationReset && isTCP:
+			tcp.SetLinger(0)
+		case termination == ConnTerminationGraceful && isTCP:
+			// Send our FIN now, then wait for the client's without holding up the caller (ex. reap or the server shutting down)
+			c.closeErr = tcp.CloseWrite()
+			go func() {
+				// Discard anything it still sends
+				tcp.SetReadDeadline(time.Now().Add(connGracefulTimeout))
+				io.Copy(ioutil.Discard, tcp)
+				c.Conn.Close()
+			}()
+			return
+		}
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// tcpConn returns the TCP connection underneath any wrappers (ex. the PROXY protocol)
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// connTracker tracks the connections of every rebind server so stale ones can be reaped
+type connTracker struct {
+	mutex sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// newConnTracker creates an empty tracker
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+// trackedListener wraps the connections accepted by a listener
+type trackedListener struct {
+	net.Listener
+}
+
+// Accept wraps the next connection
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: conn, state: http.StateNew, since: time.Now()}, nil
+}
+
+// listener wraps l so its connections can be tracked, the server must also use connState and connContext
+func (t *connTracker) listener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l}
+}
+
+// connState follows the connection through its states (http.Server.ConnState)
+func (t *connTracker) connState(conn net.Conn, state http.ConnState) {
+	c, ok := conn.(*trackedConn)
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	c.state = state
+	c.since = time.Now()
+	c.mutex.Unlock()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch state {
+	case http.StateNew:
+		t.conns[c] = struct{}{}
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+	}
+}
+
+// connContext makes the connection available to handlers (http.Server.ConnContext)
+func (t *connTracker) connContext(ctx context.Context, conn net.Conn) context.Context {
+	if c, ok := conn.(*trackedConn); ok {
+		return context.WithValue(ctx, connKey, c)
+	}
+	return ctx
+}
+
+// reap closes the connections matching the filter, which is called with the connection's lock held
+func (t *connTracker) reap(reason string, filter func(c *trackedConn) bool) {
+	t.mutex.Lock()
+	var stale []*trackedConn
+	for c := range t.conns {
+		c.mutex.Lock()
+		if filter(c) {
+			stale = append(stale, c)
+		}
+		c.mutex.Unlock()
+	}
+	t.mutex.Unlock()
+	for _, c := range stale {
+		log.Debugf("Reaping connection from %s to %s (%s)", c.RemoteAddr(), c.LocalAddr(), reason)
+		c.Close()
+	}
+}
+
+// reapRebind closes the connections of a rebind in the family that aren't to one of the IPs its DNS answers currently point at
+func (t *connTracker) reapRebind(id uuid.UUID, ipv6 bool, current []net.IP) {
+	t.reap("rebind moved", func(c *trackedConn) bool {
+		if c.rebind != id {
+			return false
+		}
+		local, ok := c.LocalAddr().(*net.TCPAddr)
+		if !ok || (local.IP.To4() == nil) != ipv6 {
+			return false
+		}
+		for _, ip := range current {
+			if ip.Equal(local.IP) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// reapIdle closes connections that have been waiting for a request for longer than maxIdle
+func (t *connTracker) reapIdle(maxIdle time.Duration) {
+	deadline := time.Now().Add(-maxIdle)
+	t.reap("idle", func(c *trackedConn) bool {
+		return (c.state == http.StateNew || c.state == http.StateIdle) && c.since.Before(deadline)
+	})
+}
+
+// MonitorConnections reaps idle rebind server connections until the context is cancelled
+func (m *RebindManager) MonitorConnections(ctx context.Context, maxIdle time.Duration) {
+	if maxIdle <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(maxIdle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.conns.reapIdle(maxIdle)
+			}
+		}
+	}()
+}
+
+// trackedConnFromContext retrieves the connection a request arrived on, nil outside of rebind servers
+func trackedConnFromContext(ctx context.Context) *trackedConn {
+	c, _ := ctx.Value(connKey).(*trackedConn)
+	return c
+}
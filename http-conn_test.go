@@ -0,0 +1,61 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (server net.Conn, client net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestTrackedConnGracefulCloseDoesNotBlock(t *testing.T) {
+	server, client := tcpPair(t)
+	defer client.Close()
+	c := &trackedConn{Conn: server, termination: ConnTerminationGraceful}
+	// The client never closes its side, Close must not wait for it
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > connGracefulTimeout/2 {
+		t.Fatalf("graceful close blocked for %s", elapsed)
+	}
+	// The client still sees our FIN straight away
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF once the server closed its side, got %v", err)
+	}
+	// Once the client closes its side the connection is closed for good
+	client.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := server.Write([]byte("x")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be closed after the client's FIN")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
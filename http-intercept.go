@@ -0,0 +1,190 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+// Binding a server for every leased address and port needs a lot of sockets (and privileges for low ports)
+// In intercept mode firewall rules steer the traffic for every pool address and port to a single listener instead
+// Servers then become registrations of the destinations they'd have been bound to, connections to anything else are refused with a RST
+
+// InterceptMode is how the firewall rules hand connections to the intercept listener
+type InterceptMode int
+
+const (
+	InterceptTPROXY   InterceptMode = iota // TPROXY rules, the listener is IP_TRANSPARENT and connections keep their destination
+	InterceptRedirect                      // REDIRECT (or DNAT) rules, the destination is recovered with SO_ORIGINAL_DST
+)
+
+// ParseInterceptMode parses the mode's name ("tproxy" or "redirect")
+func ParseInterceptMode(raw string) (InterceptMode, error) {
+	switch raw {
+	case "tproxy":
+		return InterceptTPROXY, nil
+	case "redirect":
+		return InterceptRedirect, nil
+	}
+	return 0, fmt.Errorf(`unknown intercept mode "%s"`, raw)
+}
+
+// String is used for logging
+func (mode InterceptMode) String() string {
+	if mode == InterceptRedirect {
+		return "redirect"
+	}
+	return "tproxy"
+}
+
+// interceptor routes the connections accepted by the intercept listeners to the registered destinations
+type interceptor struct {
+	mode  InterceptMode
+	conns *connTracker
+	mutex sync.RWMutex
+	dests map[string]*Address // Registered destinations by internal address
+}
+
+// register makes the address reachable through the intercept listener, returning the logical server for it
+func (i *interceptor) register(addr *Address) *HTTPServer {
+	i.mutex.Lock()
+	i.dests[addr.InternalAddr()] = addr
+	i.mutex.Unlock()
+	log.Debugf(`Registered "%s" with the intercept listener`, addr)
+	return &HTTPServer{
+		Address:   addr,
+		intercept: i,
+	}
+}
+
+// unregister refuses new connections to the address and closes the ones still open, like shutting a bound server down would
+func (i *interceptor) unregister(addr *Address) {
+	dest := addr.InternalAddr()
+	i.mutex.Lock()
+	delete(i.dests, dest)
+	i.mutex.Unlock()
+	i.conns.reap("unregistered", func(c *trackedConn) bool {
+		return c.local != nil && c.local.String() == dest
+	})
+}
+
+// lookup returns the registered address for a destination, nil if nothing is registered for it
+func (i *interceptor) lookup(dest *net.TCPAddr) *Address {
+	addr := &Address{InternalIP: dest.IP, Port: strconv.Itoa(dest.Port)}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.dests[addr.InternalAddr()]
+}
+
+// destination returns where the client was connecting to before the firewall steered the connection to us
+func (i *interceptor) destination(conn net.Conn) (*net.TCPAddr, error) {
+	tcp, ok := tcpConn(conn)
+	if !ok {
+		return nil, fmt.Errorf("unexpected connection type %T", conn)
+	}
+	if i.mode == InterceptRedirect {
+		return OriginalDestination(tcp)
+	}
+	return tcp.LocalAddr().(*net.TCPAddr), nil
+}
+
+// interceptListener only hands out connections for registered destinations, it wraps a listener from connTracker
+type interceptListener struct {
+	net.Listener
+	intercept *interceptor
+}
+
+// Accept waits for the next connection to a registered destination
+func (l *interceptListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c := conn.(*trackedConn)
+		dest, err := l.intercept.destination(c.Conn)
+		if err != nil {
+			log.Warnf("Couldn't find the destination of a connection: %v", err)
+			c.Close()
+			continue
+		}
+		// Clients expect an unbound address to refuse the connection
+		if l.intercept.lookup(dest) == nil {
+			log.Debugf("Refusing connection to %s, nothing is registered for it", dest)
+			c.tag(uuid.UUID{}, ConnTerminationReset)
+			c.Close()
+			continue
+		}
+		c.local = dest
+		return c, nil
+	}
+}
+
+// Intercept starts the intercept listeners on the binds, every HTTP server created afterwards is registered with them instead of bound
+// It must be called before Listen, the listeners are shut down when the context is cancelled
+func (m *RebindManager) Intercept(ctx context.Context, wg *sync.WaitGroup, binds []string, mode InterceptMode) error {
+	i := &interceptor{
+		mode:  mode,
+		conns: m.conns,
+		dests: make(map[string]*Address),
+	}
+	for _, bind := range binds {
+		var l net.Listener
+		var err error
+		if mode == InterceptTPROXY {
+			l, err = ListenTransparent(bind)
+		} else {
+			l, err = net.Listen("tcp", bind)
+		}
+		if err != nil {
+			return fmt.Errorf(`couldn't start the intercept listener on "%s": %v`, bind, err)
+		}
+		srv := &http.Server{
+			Handler: m.clientMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				// Log the request against the destination, as if it had its own server
+				dest := trackedConnFromContext(req.Context()).LocalAddr().(*net.TCPAddr)
+				addr := i.lookup(dest)
+				if addr == nil {
+					http.Error(rw, "Not Found", http.StatusNotFound)
+					return
+				}
+				m.accessLogMiddleware(addr, m.serveHTTP(addr)).ServeHTTP(rw, req)
+			})),
+			// Inject the context into each request
+			BaseContext: func(net.Listener) context.Context {
+				return ctx
+			},
+			ConnState:   m.conns.connState,
+			ConnContext: m.conns.connContext,
+		}
+		// Same as the bound servers, every request needs a new connection
+		srv.SetKeepAlivesEnabled(false)
+		wg.Add(1)
+		go func(bind string) {
+			defer wg.Done()
+			log.Infof(`Created intercept listener (%s) bound to "%s"`, mode, bind)
+			if err := srv.Serve(&interceptListener{Listener: m.conns.listener(m.proxyListener(l)), intercept: i}); err != nil && err != http.ErrServerClosed {
+				log.Errorf(`Intercept listener bound to "%s" failed: %v`, bind, err)
+			}
+			log.Infof(`Closed intercept listener bound to "%s"`, bind)
+		}(bind)
+		go func() {
+			<-ctx.Done()
+			shutdownHTTPServer(srv)
+		}()
+	}
+	// Nothing is bound per address any more, so any port is usable
+	m.pool.SetUnprivilegedPortStart(0)
+	m.intercept = i
+	return nil
+}
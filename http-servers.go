@@ -0,0 +1,228 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The registry shares one HTTP server per bind address between every rebind using it
+// Concurrent checkouts of an address collapse into a single creation, and a server is only shut down once the last reference is returned
+// Checkouts that race with a shutdown wait for it to finish and create a fresh server, so nothing is ever handed a stopped server
+// Servers the retain hook picks are kept open (warm) for the idle timeout after the last reference is returned, the next checkout picks them back up without binding again
+
+// httpServerSlot is the registry entry for a bind address, all fields except srv and err are guarded by the registry lock
+type httpServerSlot struct {
+	srv     *HTTPServer
+	err     error         // Set if creating the server failed
+	ready   chan struct{} // Closed once creation finished, srv and err may only be read after
+	closed  chan struct{} // Closed once the server has shut down
+	refs    int           // Checkouts not yet returned (including those waiting on ready)
+	closing bool          // The last reference was returned and the server is shutting down
+	idle    bool          // No references are left but the server is kept warm
+	idleGen int           // Incremented each time the server goes idle, so a stale expiry doesn't close it
+	timer   *time.Timer   // Expires the idle server, nil if it's kept until shutdown
+}
+
+// httpServerRegistry tracks the running HTTP servers by bind address
+type httpServerRegistry struct {
+	mutex       sync.Mutex
+	servers     map[string]*httpServerSlot
+	shutdown    func(*HTTPServer)      // Stops a server and waits for it to close
+	retain      func(*HTTPServer) bool // Picks the servers kept warm once idle, nil to close every server right away
+	idleTimeout time.Duration          // How long warm servers are kept idle, 0 until shutdown
+	warmStarts  uint64                 // Checkouts that picked up a warm server
+	coldStarts  uint64                 // Checkouts that had to bind a new server
+}
+
+// HTTPServerStats counts the HTTP servers in the registry, used for reporting to operators
+type HTTPServerStats struct {
+	Active     int    `json:"active"`     // Servers in use by at least one rebind (or bind)
+	Warm       int    `json:"warm"`       // Idle servers kept open for reuse
+	WarmStarts uint64 `json:"warmStarts"` // Checkouts that picked up a warm server
+	ColdStarts uint64 `json:"coldStarts"` // Checkouts that had to bind a new server
+}
+
+// newHTTPServerRegistry creates an empty registry
+func newHTTPServerRegistry() *httpServerRegistry {
+	return &httpServerRegistry{
+		servers:  make(map[string]*httpServerSlot),
+		shutdown: (*HTTPServer).shutdown,
+	}
+}
+
+// checkout returns the server for the key, calling create if there isn't one, every successful checkout must be returned with checkin
+// created is true for the one caller whose create was used
+func (r *httpServerRegistry) checkout(key string, create func() (*HTTPServer, error)) (srv *HTTPServer, created bool, err error) {
+	r.mutex.Lock()
+	for {
+		slot, exists := r.servers[key]
+		if !exists {
+			break
+		}
+		// Wait for the old server to release the address before binding a new one
+		if slot.closing {
+			r.mutex.Unlock()
+			<-slot.closed
+			r.mutex.Lock()
+			continue
+		}
+		slot.refs++
+		if slot.idle {
+			slot.idle = false
+			if slot.timer != nil {
+				slot.timer.Stop()
+				slot.timer = nil
+			}
+			r.warmStarts++
+			log.Debugf("Picked up warm HTTPServer %s", key)
+		}
+		r.mutex.Unlock()
+		<-slot.ready
+		return slot.srv, false, slot.err
+	}
+	slot := &httpServerSlot{
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+		refs:   1,
+	}
+	r.servers[key] = slot
+	r.coldStarts++
+	r.mutex.Unlock()
+	slot.srv, slot.err = create()
+	if slot.err != nil {
+		// Nobody holds a usable reference, the next checkout tries again
+		r.mutex.Lock()
+		delete(r.servers, key)
+		r.mutex.Unlock()
+		close(slot.closed)
+	}
+	close(slot.ready)
+	return slot.srv, slot.err == nil, slot.err
+}
+
+// checkin returns a reference from checkout, shutting the server down (or keeping it warm) when it was the last one
+func (r *httpServerRegistry) checkin(key string) {
+	r.mutex.Lock()
+	slot, exists := r.servers[key]
+	if !exists || slot.closing || slot.idle {
+		r.mutex.Unlock()
+		log.Errorf("HTTPServer %s was returned more times than it was checked out", key)
+		return
+	}
+	slot.refs--
+	if slot.refs > 0 {
+		r.mutex.Unlock()
+		return
+	}
+	if r.retain != nil && r.retain(slot.srv) {
+		r.idle(key, slot, true)
+		r.mutex.Unlock()
+		return
+	}
+	r.close(key, slot)
+}
+
+// prestart creates the server for the key ahead of its first checkout, it's kept warm until then whatever the idle timeout
+func (r *httpServerRegistry) prestart(key string, create func() (*HTTPServer, error)) error {
+	if _, _, err := r.checkout(key, create); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	slot := r.servers[key]
+	if slot.refs--; slot.refs > 0 {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.idle(key, slot, false)
+	r.mutex.Unlock()
+	return nil
+}
+
+// idle keeps a server without references warm, expiring it after the idle timeout if expire is set, it must be called with the lock held
+func (r *httpServerRegistry) idle(key string, slot *httpServerSlot, expire bool) {
+	slot.idle = true
+	slot.idleGen++
+	if !expire || r.idleTimeout <= 0 {
+		return
+	}
+	gen := slot.idleGen
+	slot.timer = time.AfterFunc(r.idleTimeout, func() {
+		r.mutex.Lock()
+		if r.servers[key] != slot || !slot.idle || slot.idleGen != gen {
+			r.mutex.Unlock()
+			return
+		}
+		log.Debugf("Warm HTTPServer %s expired", key)
+		r.close(key, slot)
+	})
+}
+
+// close shuts a server without references down, it must be called with the lock held and releases it
+func (r *httpServerRegistry) close(key string, slot *httpServerSlot) {
+	slot.closing = true
+	slot.idle = false
+	if slot.timer != nil {
+		slot.timer.Stop()
+		slot.timer = nil
+	}
+	r.mutex.Unlock()
+	r.shutdown(slot.srv)
+	r.mutex.Lock()
+	delete(r.servers, key)
+	r.mutex.Unlock()
+	close(slot.closed)
+}
+
+// closeIdle shuts down every warm server, used when the process is shutting down
+func (r *httpServerRegistry) closeIdle() {
+	r.mutex.Lock()
+	var idle []string
+	for key, slot := range r.servers {
+		if slot.idle {
+			idle = append(idle, key)
+		}
+	}
+	r.mutex.Unlock()
+	for _, key := range idle {
+		r.mutex.Lock()
+		if slot, exists := r.servers[key]; exists && slot.idle {
+			r.close(key, slot)
+		} else {
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// stats counts the servers in the registry
+func (r *httpServerRegistry) stats() HTTPServerStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stats := HTTPServerStats{
+		WarmStarts: r.warmStarts,
+		ColdStarts: r.coldStarts,
+	}
+	for _, slot := range r.servers {
+		switch {
+		case slot.idle:
+			stats.Warm++
+		case !slot.closing:
+			stats.Active++
+		}
+	}
+	return stats
+}
+
+// refs returns the number of references to the server for the key, mostly useful for debugging
+func (r *httpServerRegistry) refs(key string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if slot, exists := r.servers[key]; exists && !slot.closing {
+		return slot.refs
+	}
+	return 0
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These are meant to be run with -race
+
+// fakeServers counts the servers created and shut down through a registry, failing the test if two are ever live for the same key
+type fakeServers struct {
+	t         *testing.T
+	mutex     sync.Mutex
+	live      map[string]int
+	created   int64
+	shutdowns int64
+}
+
+// newFakeRegistry creates a registry whose servers are never bound
+func newFakeRegistry(t *testing.T) (*httpServerRegistry, *fakeServers) {
+	f := &fakeServers{t: t, live: make(map[string]int)}
+	r := newHTTPServerRegistry()
+	r.shutdown = func(srv *HTTPServer) {
+		f.mutex.Lock()
+		f.live[srv.Address.Host]--
+		f.mutex.Unlock()
+		atomic.AddInt64(&f.shutdowns, 1)
+	}
+	return r, f
+}
+
+// create returns a create func for the key
+func (f *fakeServers) create(key string) func() (*HTTPServer, error) {
+	return func() (*HTTPServer, error) {
+		f.mutex.Lock()
+		f.live[key]++
+		if f.live[key] > 1 {
+			f.t.Errorf("%d servers live for %s", f.live[key], key)
+		}
+		f.mutex.Unlock()
+		atomic.AddInt64(&f.created, 1)
+		// Give concurrent checkouts a chance to pile up
+		time.Sleep(time.Millisecond)
+		return &HTTPServer{Address: &Address{Host: key}}, nil
+	}
+}
+
+func TestHTTPServerRegistryCollapsesCreates(t *testing.T) {
+	r, f := newFakeRegistry(t)
+	const n = 64
+	servers := make([]*HTTPServer, n)
+	var wg sync.WaitGroup
+	for idx := 0; idx < n; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			srv, _, err := r.checkout("a", f.create("a"))
+			if err != nil {
+				t.Error(err)
+			}
+			servers[idx] = srv
+		}(idx)
+	}
+	wg.Wait()
+	if f.created != 1 {
+		t.Fatalf("expected 1 server to be created, got %d", f.created)
+	}
+	for _, srv := range servers {
+		if srv != servers[0] {
+			t.Fatal("checkouts were handed different servers")
+		}
+	}
+	if refs := r.refs("a"); refs != n {
+		t.Fatalf("expected %d references, got %d", n, refs)
+	}
+	for idx := 0; idx < n; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.checkin("a")
+		}()
+	}
+	wg.Wait()
+	if f.shutdowns != 1 {
+		t.Fatalf("expected 1 shutdown, got %d", f.shutdowns)
+	}
+	if refs := r.refs("a"); refs != 0 {
+		t.Fatalf("expected no references, got %d", refs)
+	}
+}
+
+func TestHTTPServerRegistryCheckoutDuringShutdown(t *testing.T) {
+	r, f := newFakeRegistry(t)
+	shutdown := r.shutdown
+	stopping := make(chan struct{})
+	unblock := make(chan struct{})
+	var stopped int32
+	r.shutdown = func(srv *HTTPServer) {
+		close(stopping)
+		<-unblock
+		shutdown(srv)
+		atomic.StoreInt32(&stopped, 1)
+	}
+	first, _, err := r.checkout("a", f.create("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.checkin("a")
+	<-stopping
+	// The checkout must wait for the old server to stop, then get a new one
+	done := make(chan *HTTPServer)
+	go func() {
+		srv, created, err := r.checkout("a", func() (*HTTPServer, error) {
+			if atomic.LoadInt32(&stopped) == 0 {
+				t.Error("created a server before the old one stopped")
+			}
+			return f.create("a")()
+		})
+		if err != nil || !created {
+			t.Errorf("expected a new server, got created=%v err=%v", created, err)
+		}
+		done <- srv
+	}()
+	select {
+	case <-done:
+		t.Fatal("checkout didn't wait for the shutdown")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(unblock)
+	if second := <-done; second == first {
+		t.Fatal("checkout was handed the stopped server")
+	}
+	r.shutdown = shutdown
+	r.checkin("a")
+}
+
+func TestHTTPServerRegistryCreateError(t *testing.T) {
+	r, f := newFakeRegistry(t)
+	failed := errors.New("bind failed")
+	const n = 16
+	var wg sync.WaitGroup
+	for idx := 0; idx < n; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv, _, err := r.checkout("a", func() (*HTTPServer, error) {
+				time.Sleep(time.Millisecond)
+				return nil, failed
+			})
+			if srv != nil || err != failed {
+				t.Errorf("expected the create error, got %v %v", srv, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refs := r.refs("a"); refs != 0 {
+		t.Fatalf("expected no references after a failed create, got %d", refs)
+	}
+	// A later checkout tries again
+	if _, created, err := r.checkout("a", f.create("a")); err != nil || !created {
+		t.Fatalf("expected a retry to create the server, got created=%v err=%v", created, err)
+	}
+	r.checkin("a")
+	if f.shutdowns != 1 {
+		t.Fatalf("expected 1 shutdown, got %d", f.shutdowns)
+	}
+}
+
+func TestHTTPServerRegistryChurn(t *testing.T) {
+	r, f := newFakeRegistry(t)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 32; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for idx := 0; idx < 200; idx++ {
+				key := fmt.Sprintf("addr-%d", (worker+idx)%4)
+				if _, _, err := r.checkout(key, f.create(key)); err != nil {
+					t.Error(err)
+					return
+				}
+				r.checkin(key)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if f.created != f.shutdowns {
+		t.Fatalf("created %d servers but shut down %d", f.created, f.shutdowns)
+	}
+	for key, live := range f.live {
+		if live != 0 {
+			t.Fatalf("%d servers still live for %s", live, key)
+		}
+	}
+}
+
+func TestHTTPServerRegistryWarm(t *testing.T) {
+	r, f := newFakeRegistry(t)
+	r.retain = func(srv *HTTPServer) bool {
+		return srv.Address.Host == "warm"
+	}
+	r.idleTimeout = 20 * time.Millisecond
+	first, _, err := r.checkout("warm", f.create("warm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.checkin("warm")
+	if stats := r.stats(); stats.Warm != 1 || stats.Active != 0 || atomic.LoadInt64(&f.shutdowns) != 0 {
+		t.Fatalf("expected the server to be kept warm, got %+v", stats)
+	}
+	// The next checkout picks the same server back up
+	second, created, err := r.checkout("warm", f.create("warm"))
+	if err != nil || created || second != first {
+		t.Fatalf("expected the warm server, got created=%v err=%v", created, err)
+	}
+	if stats := r.stats(); stats.Active != 1 || stats.WarmStarts != 1 || stats.ColdStarts != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// Outliving the idle timeout while in use doesn't close it
+	time.Sleep(2 * r.idleTimeout)
+	if atomic.LoadInt64(&f.shutdowns) != 0 {
+		t.Fatal("a server in use was expired")
+	}
+	r.checkin("warm")
+	time.Sleep(2 * r.idleTimeout)
+	if stats := r.stats(); stats.Warm != 0 || atomic.LoadInt64(&f.shutdowns) != 1 {
+		t.Fatalf("expected the idle server to expire, got %+v", stats)
+	}
+	// Servers that aren't retained close right away
+	if _, _, err := r.checkout("cold", f.create("cold")); err != nil {
+		t.Fatal(err)
+	}
+	r.checkin("cold")
+	if atomic.LoadInt64(&f.shutdowns) != 2 {
+		t.Fatal("expected the cold server to be shut down")
+	}
+}
+
+func TestHTTPServerRegistryPrestart(t *testing.T) {
+	r, f := newFakeRegistry(t)
+	r.retain = func(srv *HTTPServer) bool {
+		return true
+	}
+	r.idleTimeout = 5 * time.Millisecond
+	if err := r.prestart("a", f.create("a")); err != nil {
+		t.Fatal(err)
+	}
+	// Prestarted servers wait for their first user whatever the idle timeout
+	time.Sleep(4 * r.idleTimeout)
+	if stats := r.stats(); stats.Warm != 1 {
+		t.Fatalf("expected the prestarted server to be warm, got %+v", stats)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := 0; idx < 100; idx++ {
+				if _, _, err := r.checkout("a", f.create("a")); err != nil {
+					t.Error(err)
+					return
+				}
+				r.checkin("a")
+			}
+		}()
+	}
+	wg.Wait()
+	r.closeIdle()
+	if stats := r.stats(); stats.Warm != 0 || stats.Active != 0 {
+		t.Fatalf("expected every server to be closed, got %+v", stats)
+	}
+	if f.created != f.shutdowns {
+		t.Fatalf("created %d servers but shut down %d", f.created, f.shutdowns)
+	}
+}
+
+func TestGetHTTPServerAfterRemap(t *testing.T) {
+	// Find a free port for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	target := NewAddress("192.168.1.1:" + port)
+	m := NewRebindManager("rebind.test", []*Address{NewAddress("127.0.0.1")}, nil)
+	before, releaseBefore := context.WithCancel(context.Background())
+	oldBind := m.pool.Lease(before, nil)
+	oldSrv, err := m.GetHTTPServer(before, oldBind, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The address is remapped while the server is running
+	m.pool.Discover(context.Background(), staticDiscovery(net.ParseIP("203.0.113.1")))
+	after, releaseAfter := context.WithCancel(context.Background())
+	newBind := m.pool.Lease(after, nil)
+	newSrv, err := m.GetHTTPServer(after, newBind, target)
+	if err != nil {
+		t.Fatalf("expected the running server to be shared after the remap, got %v", err)
+	}
+	key := net.JoinHostPort("127.0.0.1", port)
+	if m.servers.refs(key) != 2 {
+		t.Fatalf("expected both rebinds to share the server for %s, got %d references", key, m.servers.refs(key))
+	}
+	// Each rebind answers DNS with the external IP it leased
+	if !oldSrv.Address.ExternalIP.Equal(net.ParseIP("127.0.0.1")) || !newSrv.Address.ExternalIP.Equal(net.ParseIP("203.0.113.1")) {
+		t.Fatalf("expected the old and new external IPs, got %s and %s", oldSrv.Address.ExternalIP, newSrv.Address.ExternalIP)
+	}
+	if status := m.pool.Status(); len(status[0].Conflicts) != 0 || !status[0].Healthy {
+		t.Fatalf("expected the remapped address to stay usable, got %+v", status[0])
+	}
+	// The server closes once both are done, leaving nothing behind under either mapping
+	releaseBefore()
+	releaseAfter()
+	deadline := time.Now().Add(2 * time.Second)
+	for m.servers.stats().Active > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the server to be shut down, got %+v", m.servers.stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l, err := net.Listen("tcp", key); err != nil {
+		t.Fatalf("expected the port to be released: %v", err)
+	} else {
+		l.Close()
+	}
+}
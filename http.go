@@ -8,83 +8,142 @@ package main
 import (
 	"context"
 	"io"
+	"net"
 	"net/http"
 	"regexp"
-	"sync"
+	"strings"
 	"time"
 
-	//	"github.com/satori/go.uuid"
-
-	"github.com/tylerb/graceful"
+	"github.com/satori/go.uuid"
 )
 
 // HTTPServer represents a server that can handle HTTP requests
 type HTTPServer struct {
-	Address *Address         // Mainly used for debugging
-	Server  *graceful.Server // http.Server has no clean way to shutdown, use graceful as a substitute
-	WG      *sync.WaitGroup  // We use a WaitGroup to cleanup the server when no active rebinds reference it anymore
+	Address   *Address // The bind address, as leased by whoever got the server from GetHTTPServer (the registry's copy keeps the one it was created with)
+	Server    *http.Server
+	intercept *interceptor // Set instead of Server for destinations registered with the intercept listener
 }
 
 // Used for matching UUIDs (ending in a dot for subdomains)
 var SubdomainRegex = regexp.MustCompile("^([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})\\.")
 
-// CreateHTTPServer creates a *HTTPServer instance and adds it to the HTTPServers map
-func (m *RebindManager) CreateHTTPServer(ctx context.Context, addr *Address) *HTTPServer {
-	// Create a graceful server because Golang needs to fix the stdlib
+// lookupRebind finds the rebind a host (or DNS name) belongs to from its UUID subdomain
+func (m *RebindManager) lookupRebind(host string) (id uuid.UUID, rebind RebindMethod, ok bool) {
+	matches := SubdomainRegex.FindStringSubmatch(strings.ToLower(host))
+	if len(matches) != 2 {
+		return
+	}
+	id, err := uuid.FromString(matches[1])
+	if err != nil {
+		return
+	}
+	m.RebindsLock.RLock()
+	rebind, ok = m.Rebinds[id]
+	m.RebindsLock.RUnlock()
+	return
+}
+
+// CreateHTTPServer creates a *HTTPServer instance, use GetHTTPServer to share servers through the registry
+// The address is bound before returning, so bind errors are returned instead of taking down the process
+// With an intercept listener nothing is bound, the address is registered with it instead
+func (m *RebindManager) CreateHTTPServer(ctx context.Context, addr *Address) (*HTTPServer, error) {
+	if m.intercept != nil {
+		return m.intercept.register(addr), nil
+	}
+	l, err := listenAddress(addr)
+	if err != nil {
+		return nil, err
+	}
 	var srv HTTPServer
 	srv.Address = addr
-	srv.WG = new(sync.WaitGroup)
-	srv.WG.Add(1)
-	srv.Server = &graceful.Server{
-		Timeout: 5 * time.Second, // This is only used during cleanup on SIGSTOP
-		Server: &http.Server{
-			Addr: addr.InternalAddr(),
-			Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-				// If we can find a matching rebind, call the middleware
-				/*matches := SubdomainRegex.FindStringSubmatch(req.Host)
-				if (len(matches) > 1) {
-					u, err := uuid.FromString(matches[1])
-					if err == nil {
-						m.RebindsLock.RLock()
-						rebind, ok := m.Rebinds[u]
-						m.RebindsLock.RUnlock()
-						if ok {
-							rebind.HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-								m.HTTPMux.ServeHTTP(rw, req.WithContext(ctx))
-							}))
-							return
-						}
-					}
-				}*/
-				// Inject the context into each request
-				m.HTTPMux.ServeHTTP(rw, req.WithContext(ctx))
-			}),
+	srv.Server = &http.Server{
+		Addr:    addr.InternalAddr(),
+		Handler: m.clientMiddleware(m.accessLogMiddleware(addr, m.serveHTTP(addr))),
+		// Inject the context into each request
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
 		},
+		ConnState:   m.conns.connState,
+		ConnContext: m.conns.connContext,
 	}
 	// VERY VERY VERY IMPORTANT DO NOT REMOVE
 	// The server must release the connection after each request so a new DNS request is triggered for each new HTTP request (assuming the cached DNS request has expired)
 	// This is essential for DNS rebinding to work.
-	srv.Server.Server.SetKeepAlivesEnabled(false)
-	go func() {
-		srv.WG.Wait()
-		m.HTTPServersLock.Lock()
-		log.Infof("HTTPServer: [end] - %s", addr)
-		srv.Server.Stop(1 * time.Second)     // We can be aggressive here since it shouldn't be still referenced by anybody
-		<-srv.Server.StopChan()              // Wait for it to actually close
-		delete(m.HTTPServers, addr.String()) // Remove from list of usable servers
-		m.HTTPServersLock.Unlock()
-	}()
-	// TODO: Are we introducing a race-condition? ("just" DoS if true)
-	m.HTTPServersLock.Lock()
-	m.HTTPServers[addr.String()] = &srv
-	m.HTTPServersLock.Unlock()
-	// Begin listening in the background
+	srv.Server.SetKeepAlivesEnabled(false)
+	// Begin serving in the background
 	go func() {
-		if err := srv.Server.ListenAndServe(); err != nil {
-			log.Fatal(err)
+		if err := srv.Server.Serve(m.conns.listener(m.proxyListener(l))); err != nil && err != http.ErrServerClosed {
+			log.Errorf("HTTPServer bound to %s failed: %v", addr, err)
 		}
 	}()
-	return &srv
+	return &srv, nil
+}
+
+// serveHTTP handles every request to the HTTP server bound to addr, if we can find a matching rebind the request is run through its middleware
+// Other requests to a main bind also get the routes only main binds serve
+func (m *RebindManager) serveHTTP(addr *Address) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if id, rebind, ok := m.lookupRebind(req.Host); ok {
+			// End the connection the way the method wants once the request is answered
+			if conn := trackedConnFromContext(req.Context()); conn != nil {
+				conn.tag(id, rebind.ConnTermination())
+			}
+			rw.Header().Set("Connection", "close")
+			req = req.WithContext(context.WithValue(req.Context(), rebindIDKey, id))
+			rebind.HTTPMiddleware(m.HTTPMux).ServeHTTP(rw, req)
+			return
+		}
+		if bind := m.lookupMainBind(addr); bind != nil {
+			m.mainHandler(bind).ServeHTTP(rw, req)
+			return
+		}
+		m.HTTPMux.ServeHTTP(rw, req)
+	})
+}
+
+// lookupMainBind returns the configured main bind served by the server bound to addr, nil if it isn't one
+func (m *RebindManager) lookupMainBind(addr *Address) *Address {
+	m.mainBindsLock.RLock()
+	defer m.mainBindsLock.RUnlock()
+	return m.mainBinds[addr.InternalAddr()]
+}
+
+// mainHandler serves the requests to a main bind, carrying the configured bind in the request context
+func (m *RebindManager) mainHandler(bind *Address) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		m.mainMux.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), mainBindKey, bind)))
+	})
+}
+
+// httpShutdownTimeout is how long in-flight requests get to finish when a server shuts down
+const httpShutdownTimeout = 1 * time.Second
+
+// shutdown stops the server and waits for it to close
+func (srv *HTTPServer) shutdown() {
+	log.Infof("HTTPServer: [end] - %s", srv.Address)
+	if srv.intercept != nil {
+		srv.intercept.unregister(srv.Address)
+		return
+	}
+	shutdownHTTPServer(srv.Server) // We can be aggressive here since it shouldn't be still referenced by anybody
+}
+
+// shutdownHTTPServer gracefully shuts a server down, closing whatever is still open after httpShutdownTimeout
+func shutdownHTTPServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+	}
+}
+
+// listenAddress opens a TCP listener on the internal address
+func listenAddress(addr *Address) (net.Listener, error) {
+	// Addresses synthesized from a prefix aren't configured on any interface
+	if addr.Freebind {
+		return ListenFreebind(addr.InternalAddr())
+	}
+	return net.Listen("tcp", addr.InternalAddr())
 }
 
 // IndexHandler handles requests for the index page
@@ -92,6 +151,15 @@ func (m *RebindManager) IndexHandler(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "Index")
 }
 
+// LandingHandler serves the landing page on the main binds if the operator provided one, anything else is handled by the shared mux
+func (m *RebindManager) LandingHandler(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/" && m.payloads.index != nil {
+		m.payloads.Serve(w, m.payloads.index, m.payloadData(req))
+		return
+	}
+	m.HTTPMux.ServeHTTP(w, req)
+}
+
 // PingHandler handles requests for the ping page
 func (m *RebindManager) PingHandler(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "pong")
@@ -99,17 +167,20 @@ func (m *RebindManager) PingHandler(w http.ResponseWriter, req *http.Request) {
 
 // JSHandler handles requests for the js
 func (m *RebindManager) JSHandler(w http.ResponseWriter, req *http.Request) {
-	http.ServeFile(w, req, "www/rebind.js")
+	m.assets.Serve(w, "rebind.js", m.assetData(req))
 }
 
 // RebindHandler handles requests for a given host
 func (m *RebindManager) RebindHandler(w http.ResponseWriter, req *http.Request) {
-	// Let the rebind method handle the request
-	http.ServeFile(w, req, "www/frame.html")
+	m.assets.Serve(w, "frame.html", m.assetData(req))
+}
+
+// NavigateHandler handles requests for the top-level page of a navigation rebind
+func (m *RebindManager) NavigateHandler(w http.ResponseWriter, req *http.Request) {
+	m.assets.Serve(w, "navigate.html", m.assetData(req))
 }
 
 // CacheHandler handles requests for a given host
 func (m *RebindManager) CacheHandler(w http.ResponseWriter, req *http.Request) {
-	// Let the rebind method handle the request
-	http.ServeFile(w, req, "www/frame.appcache")
+	m.assets.Serve(w, "frame.appcache", m.assetData(req))
 }
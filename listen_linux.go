@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// capNetBindService is the capability bit allowing binds to privileged ports
+const capNetBindService = 10
+
+// Socket options missing from syscall
+const (
+	soOriginalDst      = 80 // SO_ORIGINAL_DST (and IP6T_SO_ORIGINAL_DST) from linux/netfilter_ipv4.h
+	solIPv6Transparent = 75 // IPV6_TRANSPARENT from linux/in6.h
+)
+
+// ListenFreebind listens on addr with IP_FREEBIND set, allowing the bind to succeed for addresses not configured on any interface
+func ListenFreebind(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			ctrlErr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenTransparent listens on addr with IP_TRANSPARENT (and IPV6_TRANSPARENT) set so TPROXY rules can hand it connections for any destination
+// Accepted connections keep their original destination as the local address, setting the options requires CAP_NET_ADMIN
+func ListenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			ctrlErr := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, solIPv6Transparent, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// OriginalDestination recovers the destination of a connection redirected by a REDIRECT (or DNAT) rule with SO_ORIGINAL_DST
+func OriginalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	// The option fills in a struct sockaddr_in (or sockaddr_in6 for IPv6), syscall has no getter for those so they're read with getters
+	// of the same size (a raw getsockopt isn't portable, linux/386 multiplexes it through socketcall):
+	// - IPv6MTUInfo is a sockaddr_in6 followed by the MTU, the kernel only writes the sockaddr_in6
+	// - IPv6Mreq starts with a 16 byte address, exactly the size of a sockaddr_in
+	var sa syscall.RawSockaddrInet6
+	ctrlErr := raw.Control(func(fd uintptr) {
+		if ipv6 {
+			var info *syscall.IPv6MTUInfo
+			if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err == nil {
+				sa = info.Addr
+			}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+			*(*[syscall.SizeofSockaddrInet4]byte)(unsafe.Pointer(&sa)) = mreq.Multiaddr
+		}
+	})
+	if ctrlErr != nil {
+		return nil, ctrlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sockaddrTCPAddr(&sa)
+}
+
+// sockaddrTCPAddr decodes a struct sockaddr_in or sockaddr_in6, the family is in host byte order and the port in network byte order
+func sockaddrTCPAddr(sa *syscall.RawSockaddrInet6) (*net.TCPAddr, error) {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	switch sa.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return &net.TCPAddr{IP: net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3]), Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+	case syscall.AF_INET6:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+	}
+	return nil, fmt.Errorf("unexpected address family %d for the original destination", sa.Family)
+}
+
+// PrivilegedPortStart returns the first port this process can bind without extra privileges, 0 if it can bind any port
+// Root and CAP_NET_BIND_SERVICE can bind anything, otherwise net.ipv4.ip_unprivileged_port_start decides
+func PrivilegedPortStart() int {
+	if os.Geteuid() == 0 {
+		return 0
+	}
+	if status, err := os.Open("/proc/self/status"); err == nil {
+		defer status.Close()
+		scanner := bufio.NewScanner(status)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "CapEff:") {
+				continue
+			}
+			caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "CapEff:")), 16, 64)
+			if err == nil && caps&(1<<capNetBindService) != 0 {
+				return 0
+			}
+		}
+	}
+	if raw, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if start, err := strconv.Atoi(strings.TrimSpace(string(raw))); err == nil {
+			return start
+		}
+	}
+	return 1024
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// rawSockaddr lays out a struct sockaddr_in or sockaddr_in6 the way the kernel fills it in for SO_ORIGINAL_DST
+func rawSockaddr(family uint16, ip net.IP, port int) *syscall.RawSockaddrInet6 {
+	var sa syscall.RawSockaddrInet6
+	sa.Family = family
+	// Network byte order
+	portBytes := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	portBytes[0], portBytes[1] = byte(port>>8), byte(port)
+	if family == syscall.AF_INET {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&sa))
+		copy(sa4.Addr[:], ip.To4())
+	} else {
+		copy(sa.Addr[:], ip.To16())
+	}
+	return &sa
+}
+
+func TestSockaddrTCPAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		sa   *syscall.RawSockaddrInet6
+		want string // "" if decoding should fail
+	}{
+		{"IPv4", rawSockaddr(syscall.AF_INET, net.ParseIP("203.0.113.5"), 8080), "203.0.113.5:8080"},
+		{"IPv4 high port", rawSockaddr(syscall.AF_INET, net.ParseIP("10.0.0.1"), 65535), "10.0.0.1:65535"},
+		{"IPv6", rawSockaddr(syscall.AF_INET6, net.ParseIP("2001:db8::5"), 443), "[2001:db8::5]:443"},
+		{"unknown family", rawSockaddr(syscall.AF_UNIX, net.ParseIP("10.0.0.1"), 80), ""},
+	}
+	for _, test := range tests {
+		addr, err := sockaddrTCPAddr(test.sa)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != test.want {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.want, addr, err)
+		}
+	}
+}
+
+// Without a REDIRECT rule the option fails, it must not return a garbage address
+func TestOriginalDestinationWithoutRedirect(t *testing.T) {
+	server, client := tcpPair(t)
+	defer server.Close()
+	defer client.Close()
+	if addr, err := OriginalDestination(server.(*net.TCPConn)); err == nil && addr.String() != server.LocalAddr().String() {
+		t.Fatalf("expected an error or the local address, got %s", addr)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ListenFreebind is only supported on Linux, use an AnyIP style local route elsewhere
+func ListenFreebind(addr string) (net.Listener, error) {
+	return nil, errors.New("IP_FREEBIND is only supported on linux")
+}
+
+// ListenTransparent is only supported on Linux (TPROXY)
+func ListenTransparent(addr string) (net.Listener, error) {
+	return nil, errors.New("IP_TRANSPARENT is only supported on linux")
+}
+
+// OriginalDestination is only supported on Linux (SO_ORIGINAL_DST)
+func OriginalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("SO_ORIGINAL_DST is only supported on linux")
+}
+
+// PrivilegedPortStart returns the first port this process can bind without extra privileges, 0 if it can bind any port
+func PrivilegedPortStart() int {
+	// Windows has no privileged ports (and no euid)
+	if euid := os.Geteuid(); euid == 0 || euid == -1 {
+		return 0
+	}
+	return 1024
+}
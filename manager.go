@@ -7,9 +7,13 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
 
 	"github.com/miekg/dns"
@@ -17,33 +21,69 @@ import (
 
 // RebindManager is the "global" rebinding manager (there can be multiple instances technically)
 type RebindManager struct {
-	base            string
-	pool            *Pool                      // Pool of IPs to use for HTTP servers
-	Rebinds         map[uuid.UUID]RebindMethod // Mapping of rebinding requests to Rebinding methods
-	RebindsLock     *sync.RWMutex              // Maps aren't write thread-safe (sadly)
-	HTTPMux         *http.ServeMux             // Use a shared HTTP mux
-	HTTPServers     map[string]*HTTPServer     // Mapping of addresses to server.
-	HTTPServersLock *sync.RWMutex              // Maps aren't write thread-safe (sadly)
-	DNSServers      []*dns.Server              // List of all DNS servers assoicated with the rebind manager
+	base             string
+	pool             *Pool                      // Pool of IPs to use for HTTP servers
+	Rebinds          map[uuid.UUID]RebindMethod // Mapping of rebinding requests to Rebinding methods
+	RebindOrigins    map[uuid.UUID]rebindOrigin // Mapping of rebinding requests to the socket and request they were offered to
+	RebindsLock      *sync.RWMutex              // Maps aren't write thread-safe (sadly), guards Rebinds and RebindOrigins
+	HTTPMux          *http.ServeMux             // Use a shared HTTP mux
+	mainMux          *http.ServeMux             // Routes only the main binds serve (payloads), everything else goes to HTTPMux
+	mainBinds        map[string]*Address        // The configured main HTTP binds by the internal address of their server
+	mainBindsLock    *sync.RWMutex              // Main binds are added while servers are already running (ex. prestarted ones), guards mainBinds
+	servers          *httpServerRegistry        // The HTTP servers shared by every rebind, by bind address
+	warmCtx          context.Context            // The context warm HTTP servers live for
+	warmPorts        map[string]bool            // Ports HTTP servers are kept warm on
+	conns            *connTracker               // Connections to the HTTP servers, so stale ones can be reaped
+	intercept        *interceptor               // The single listener HTTP servers are registered with instead of bound, nil to bind each of them
+	DNSServers       []*dns.Server              // List of all DNS servers assoicated with the rebind manager
+	Sockets          map[uuid.UUID]*webSocket   // Mapping of connected WebSocket clients by socket ID
+	SocketsLock      *sync.Mutex                // Maps aren't write thread-safe (sadly), guards Sockets and navigations
+	navigations      map[uuid.UUID]*navigation  // Top-level pages of navigation rebinds by rebind ID, once they attach
+	affinitySpread   int                        // Number of addresses a client is spread across, 0 disables affinity
+	affinityBySocket bool                       // Group clients by socket instead of by IP for affinity
+	poolPolicy       PoolPolicy                 // Policy every rebind method leases with, nil to use each method's own
+	assets           *Assets                    // Templates for the served web assets
+	pingInterval     time.Duration              // How often frames ping to detect the rebind
+	payloads         *Payloads                  // Operator provided pages and scripts
+	accessLog        *logrus.Logger             // Where HTTP requests are logged, the main log if nil
+	proxies          *TrustedProxies            // Proxies in front of the listeners, nil if clients connect directly
 }
 
 // NewRebindManager creates a *RebindManager instance
-func NewRebindManager(base string, poolIPs []*Address) *RebindManager {
+func NewRebindManager(base string, poolIPs []*Address, poolPrefixes []*PoolPrefix) *RebindManager {
+	assets, err := NewAssets("")
+	if err != nil {
+		log.Errorf("Failed to load the embedded assets: %v", err)
+		return nil
+	}
 	m := RebindManager{
-		base:            base,
-		pool:            NewPool(poolIPs),
-		Rebinds:         make(map[uuid.UUID]RebindMethod),
-		RebindsLock:     new(sync.RWMutex),
-		HTTPServers:     make(map[string]*HTTPServer),
-		HTTPServersLock: new(sync.RWMutex),
+		base:          base,
+		pool:          NewPool(poolIPs, poolPrefixes),
+		Rebinds:       make(map[uuid.UUID]RebindMethod),
+		RebindOrigins: make(map[uuid.UUID]rebindOrigin),
+		RebindsLock:   new(sync.RWMutex),
+		servers:       newHTTPServerRegistry(),
+		conns:         newConnTracker(),
+		Sockets:       make(map[uuid.UUID]*webSocket),
+		SocketsLock:   new(sync.Mutex),
+		navigations:   make(map[uuid.UUID]*navigation),
+		assets:        assets,
+		pingInterval:  2 * time.Second,
+		payloads:      NewPayloads(""),
+		mainBinds:     make(map[string]*Address),
+		mainBindsLock: new(sync.RWMutex),
 	}
 	m.HTTPMux = http.NewServeMux()
 	m.HTTPMux.HandleFunc("/", m.IndexHandler)
-	m.HTTPMux.HandleFunc("/v1.js", m.JSHandler)
+	m.HTTPMux.HandleFunc(scriptPath, m.JSHandler)
 	m.HTTPMux.HandleFunc("/v1.websocket", m.WebSocketHandler)
-	m.HTTPMux.HandleFunc("/.well-known/rebind/v1.ping", m.PingHandler)
-	m.HTTPMux.HandleFunc("/.well-known/rebind/v1.frame", m.RebindHandler)
-	m.HTTPMux.HandleFunc("/.well-known/rebind/v1.appcache", m.CacheHandler)
+	m.HTTPMux.HandleFunc(pingPath, m.PingHandler)
+	m.HTTPMux.HandleFunc(framePath, m.RebindHandler)
+	m.HTTPMux.HandleFunc(cachePath, m.CacheHandler)
+	m.HTTPMux.HandleFunc(navigatePath, m.NavigateHandler)
+	m.mainMux = http.NewServeMux()
+	m.mainMux.HandleFunc("/", m.LandingHandler)
+	m.mainMux.HandleFunc(payloadPath, m.PayloadHandler)
 	return &m
 }
 
@@ -62,6 +102,14 @@ func (m *RebindManager) Listen(ctx context.Context, dnsBind string, httpBinds []
 			Net:     "udp",
 		},
 	}
+	// DNS over TCP can be behind a PROXY protocol load balancer as well
+	if m.proxies != nil && len(m.proxies.Protocol) > 0 {
+		l, err := net.Listen("tcp", dnsBind)
+		if err != nil {
+			return nil, err
+		}
+		m.DNSServers[0].Listener = m.proxyListener(l)
+	}
 	wg = new(sync.WaitGroup)
 	// Start each of the DNS servers
 	for _, srv := range m.DNSServers {
@@ -70,7 +118,11 @@ func (m *RebindManager) Listen(ctx context.Context, dnsBind string, httpBinds []
 		go func(srv *dns.Server) {
 			defer wg.Done() // When this function ends, release our waitgroup
 			log.Infof(`Created new DNSServer bound to "%s" (%s)`, srv.Addr, srv.Net)
-			if err := srv.ListenAndServe(); err != nil {
+			serve := srv.ListenAndServe
+			if srv.Listener != nil {
+				serve = srv.ActivateAndServe
+			}
+			if err := serve(); err != nil {
 				// Skip errors that occur during cancellation/shutdown
 				// TODO: ListenAndServe doesn't gracefully eat errors when shutting down, should fix upstream
 				if ctx.Err() != context.Canceled {
@@ -90,39 +142,143 @@ func (m *RebindManager) Listen(ctx context.Context, dnsBind string, httpBinds []
 	}
 	// Lease each of the HTTP servers provided in the bind arguments
 	for _, addr := range httpBinds {
-		m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaExternalIPMatch{Addr: addr}), addr)
+		bind := m.pool.Lease(ctx, nil, &PoolCriteriaExternalIPMatch{Addr: addr}, m.pool.CriteriaPort(addr.Port))
+		if bind == nil {
+			log.Fatalf(`HTTP bind address "%s" is not in the pool, is unhealthy or can't be bound to port %s`, addr, addr.Port)
+		}
+		bindAddr := bind.Clone()
+		bindAddr.Port = addr.Port
+		m.mainBindsLock.Lock()
+		m.mainBinds[bindAddr.InternalAddr()] = addr
+		m.mainBindsLock.Unlock()
+		if _, err = m.GetHTTPServer(ctx, bind, addr); err != nil {
+			return wg, fmt.Errorf(`couldn't bind HTTP bind address "%s": %v`, addr, err)
+		}
 	}
 	return
 }
 
+// SetAffinity keeps each client (by IP, or by socket if bySocket) on at most spread addresses for rebind methods that allow it
+// A spread of 0 disables affinity
+func (m *RebindManager) SetAffinity(spread int, bySocket bool) {
+	m.affinitySpread = spread
+	m.affinityBySocket = bySocket
+}
+
+// SetPoolPolicy sets the policy rebind methods that don't declare their own lease pool addresses with (nil for the pool default)
+// Affinity still applies on top of it
+func (m *RebindManager) SetPoolPolicy(policy PoolPolicy) {
+	m.poolPolicy = policy
+}
+
+// SetAssets replaces the served web assets and how often frames ping to detect the rebind
+func (m *RebindManager) SetAssets(assets *Assets, pingInterval time.Duration) {
+	m.assets = assets
+	m.pingInterval = pingInterval
+}
+
+// SetPayloads replaces the hosted payloads
+func (m *RebindManager) SetPayloads(payloads *Payloads) {
+	m.payloads = payloads
+}
+
+// MonitorPoolMappings discovers the external IP of every pool address right away, then keeps refreshing on the interval (if non-zero) until the context is cancelled
+func (m *RebindManager) MonitorPoolMappings(ctx context.Context, discovery MappingDiscovery, interval time.Duration) {
+	m.pool.Discover(ctx, discovery)
+	if interval > 0 {
+		go m.pool.MonitorDiscovery(ctx, discovery, interval)
+	}
+}
+
+// MonitorPoolHealth checks every pool address right away, then keeps re-checking on the interval (if non-zero) until the context is cancelled
+func (m *RebindManager) MonitorPoolHealth(ctx context.Context, check *PoolHealthCheck, interval time.Duration) {
+	m.pool.SetHealthCheck(check)
+	m.pool.CheckHealth()
+	if interval > 0 {
+		go m.pool.MonitorHealth(ctx, interval)
+	}
+}
+
+// WarmHTTPServers keeps HTTP servers on the ports open for idle after their last rebind is done, so bursts don't keep binding and unbinding them (0 keeps them until shutdown)
+// Only configured pool addresses are kept warm, addresses synthesized from prefixes are single use. If prestart is set a server is started on each of them for every port right away
+func (m *RebindManager) WarmHTTPServers(ctx context.Context, ports []string, idle time.Duration, prestart bool) {
+	warm := make(map[string]bool)
+	for _, port := range ports {
+		warm[port] = true
+	}
+	m.warmCtx = ctx
+	m.warmPorts = warm
+	m.servers.idleTimeout = idle
+	m.servers.retain = func(srv *HTTPServer) bool {
+		return ctx.Err() == nil && warm[srv.Address.Port] && m.pool.IsConfigured(srv.Address.IP())
+	}
+	// Warm servers don't belong to any rebind, close them with the process
+	go func() {
+		<-ctx.Done()
+		m.servers.closeIdle()
+	}()
+	if !prestart {
+		return
+	}
+	for _, bind := range m.pool.Configured() {
+		for _, port := range ports {
+			if !m.pool.CriteriaPort(port).Eligible(nil, bind) {
+				continue
+			}
+			bindAddr := bind.Clone()
+			bindAddr.Port = port
+			err := m.servers.prestart(bindAddr.InternalAddr(), func() (*HTTPServer, error) {
+				return m.CreateHTTPServer(ctx, bindAddr)
+			})
+			if err != nil {
+				log.Warnf(`Couldn't prestart HTTPServer bound to "%s": %v`, bindAddr, err)
+				continue
+			}
+			log.Infof(`Prestarted HTTPServer bound to "%s"`, bindAddr)
+		}
+	}
+	stats := m.servers.stats()
+	log.Infof("%d warm HTTPServer(s) ready", stats.Warm)
+}
+
+// HTTPServerStats counts the running HTTP servers, both active and warm
+func (m *RebindManager) HTTPServerStats() HTTPServerStats {
+	return m.servers.stats()
+}
+
 // GetHTTPServer will attempt to bind a http server instance to the provided bind IP on the port from addr, spawning a new one if needed
-func (m *RebindManager) GetHTTPServer(ctx context.Context, bind *Address, addr *Address) (srv *HTTPServer) {
+// Servers are shared by internal address, the returned *HTTPServer carries the caller's bind address so its DNS answers use the
+// external IP it leased, even if the address was remapped since the server was created. Errors binding a new server are returned
+// so the caller can try another address
+func (m *RebindManager) GetHTTPServer(ctx context.Context, bind *Address, addr *Address) (srv *HTTPServer, err error) {
 	// Build the bind address by combining the bind IP and the port from the target
 	bindAddr := bind.Clone()
 	bindAddr.Port = addr.Port
-	// Check if we have a srv for that bind address open already
-	m.HTTPServersLock.RLock()
-	for _, srvInstance := range m.HTTPServers {
-		if srvInstance.Address.Equal(bindAddr) {
-			srv = srvInstance
-		}
+	// Re-use the server for that bind address if there is one, otherwise spawn it (the external IP may change, the socket doesn't)
+	key := bindAddr.InternalAddr()
+	// Servers that may be kept warm outlive the rebind creating them
+	srvCtx := ctx
+	if m.warmPorts[bindAddr.Port] {
+		srvCtx = m.warmCtx
 	}
-	m.HTTPServersLock.RUnlock()
-	// There is a server already, let's re-use it
-	if srv != nil {
-		// Increment the usage since we're checking it out
-		srv.WG.Add(1)
-		log.Infof(`Incremented users of HTTPServer bound to "%s" as a result of request "%s" on socket "%s"`, srv.Address, requestID(ctx), socketID(ctx))
-		// We need to spawn a new server
-	} else {
-		srv = m.CreateHTTPServer(ctx, bindAddr)
+	srv, created, err := m.servers.checkout(key, func() (*HTTPServer, error) {
+		return m.CreateHTTPServer(srvCtx, bindAddr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if created {
 		log.Infof(`Created HTTPServer bound to "%s" as a result of request "%s" on socket "%s"`, bindAddr, requestID(ctx), socketID(ctx))
+	} else {
+		log.Infof(`Incremented users of HTTPServer bound to "%s" as a result of request "%s" on socket "%s"`, srv.Address, requestID(ctx), socketID(ctx))
 	}
 	// When the context cancels, decrement our usage of it
 	go func() {
 		<-ctx.Done()
-		srv.WG.Done()
-		log.Infof(`Decremented users of HTTPServer bound to "%s" as a result of request "%s" on socket "%s"`, srv.Address, requestID(ctx), socketID(ctx))
+		m.servers.checkin(key)
+		log.Infof(`Decremented users of HTTPServer bound to "%s" as a result of request "%s" on socket "%s"`, bindAddr, requestID(ctx), socketID(ctx))
 	}()
-	return
+	leased := *srv
+	leased.Address = bindAddr
+	return &leased, nil
 }
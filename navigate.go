@@ -0,0 +1,166 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+)
+
+// Navigation rebinds run in a top-level window instead of a frame, the page can't talk to the client's page directly (other origin, no opener)
+// It opens its own WebSocket and attaches to its rebind, then the fetches and their results are relayed between the two sockets
+
+// navigation is the top-level page of a navigation rebind
+type navigation struct {
+	socketID uuid.UUID // The page's socket
+	socket   *webSocket
+}
+
+// WebSocketNavigateMessage is any message relayed between a client and the page of one of its navigation rebinds
+type WebSocketNavigateMessage struct {
+	RebindID uuid.UUID `json:"rebindId"`
+}
+
+// WebSocketNavigateDetached tells the client the page of a navigation rebind went away
+type WebSocketNavigateDetached struct {
+	WebSocketEvent
+	RebindID uuid.UUID `json:"rebindId"`
+}
+
+// retypeWebSocketMessage changes the type in the envelope of a message that's relayed as is otherwise
+func retypeWebSocketMessage(rawMsg []byte, msgType string) (json.RawMessage, error) {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(rawMsg, &msg); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(msgType)
+	if err != nil {
+		return nil, err
+	}
+	msg["type"] = raw
+	return json.Marshal(msg)
+}
+
+// navigationOrigin returns where a navigation rebind was offered to, an error if it's unknown or not a navigation
+func (m *RebindManager) navigationOrigin(id uuid.UUID) (rebindOrigin, error) {
+	m.RebindsLock.RLock()
+	origin, ok := m.RebindOrigins[id]
+	m.RebindsLock.RUnlock()
+	if !ok || origin.Mode != RebindModeNavigate {
+		return origin, fmt.Errorf(`"%s" isn't a navigation rebind`, id)
+	}
+	return origin, nil
+}
+
+// attachNavigation registers the socket as the page of a navigation rebind, a rebind only has one page
+func (m *RebindManager) attachNavigation(ctx context.Context, socket *webSocket, id uuid.UUID) error {
+	if _, err := m.navigationOrigin(id); err != nil {
+		return err
+	}
+	m.SocketsLock.Lock()
+	defer m.SocketsLock.Unlock()
+	if _, exists := m.navigations[id]; exists {
+		return fmt.Errorf(`navigation rebind "%s" already has a page attached`, id)
+	}
+	m.navigations[id] = &navigation{
+		socketID: socketID(ctx),
+		socket:   socket,
+	}
+	log.Infof(`Socket "%s" attached to navigation rebind "%s"`, socketID(ctx), id)
+	return nil
+}
+
+// detachNavigations forgets the navigation rebinds a closing socket was the page of, telling their clients
+func (m *RebindManager) detachNavigations(socket uuid.UUID) {
+	m.SocketsLock.Lock()
+	var detached []uuid.UUID
+	for id, nav := range m.navigations {
+		if nav.socketID == socket {
+			delete(m.navigations, id)
+			detached = append(detached, id)
+		}
+	}
+	m.SocketsLock.Unlock()
+	for _, id := range detached {
+		origin, err := m.navigationOrigin(id)
+		if err != nil {
+			continue
+		}
+		m.SocketsLock.Lock()
+		client, ok := m.Sockets[origin.Socket]
+		m.SocketsLock.Unlock()
+		if !ok {
+			continue
+		}
+		msg := &WebSocketNavigateDetached{
+			WebSocketEvent: WebSocketEvent{
+				Type:   webSocketTypeEvent,
+				Action: "detached",
+			},
+			RebindID: id,
+		}
+		if err := client.WriteJSON(msg); err != nil {
+			log.Warnf(`Couldn't tell socket "%s" that navigation rebind "%s" detached: %v`, origin.Socket, id, err)
+		}
+	}
+}
+
+// relayToNavigation forwards a request from the client that was offered a navigation rebind to its page, as an event
+func (m *RebindManager) relayToNavigation(ctx context.Context, rawMsg []byte) error {
+	var msg WebSocketNavigateMessage
+	if err := json.Unmarshal(rawMsg, &msg); err != nil {
+		return err
+	}
+	origin, err := m.navigationOrigin(msg.RebindID)
+	if err != nil {
+		return err
+	}
+	if origin.Socket != socketID(ctx) {
+		return fmt.Errorf(`navigation rebind "%s" wasn't offered to socket "%s"`, msg.RebindID, socketID(ctx))
+	}
+	m.SocketsLock.Lock()
+	nav, ok := m.navigations[msg.RebindID]
+	m.SocketsLock.Unlock()
+	if !ok {
+		return fmt.Errorf(`navigation rebind "%s" has no page attached`, msg.RebindID)
+	}
+	relayed, err := retypeWebSocketMessage(rawMsg, webSocketTypeEvent)
+	if err != nil {
+		return err
+	}
+	return nav.socket.WriteJSON(relayed)
+}
+
+// relayFromNavigation forwards a message from the page of a navigation rebind to the client it was offered to, as msgType
+func (m *RebindManager) relayFromNavigation(ctx context.Context, rawMsg []byte, msgType string) error {
+	var msg WebSocketNavigateMessage
+	if err := json.Unmarshal(rawMsg, &msg); err != nil {
+		return err
+	}
+	origin, err := m.navigationOrigin(msg.RebindID)
+	if err != nil {
+		return err
+	}
+	m.SocketsLock.Lock()
+	nav, attached := m.navigations[msg.RebindID]
+	client, connected := m.Sockets[origin.Socket]
+	m.SocketsLock.Unlock()
+	if !attached || nav.socketID != socketID(ctx) {
+		return fmt.Errorf(`socket "%s" isn't the page of navigation rebind "%s"`, socketID(ctx), msg.RebindID)
+	}
+	if !connected {
+		log.Debugf(`Dropping message from navigation rebind "%s", socket "%s" has closed`, msg.RebindID, origin.Socket)
+		return nil
+	}
+	relayed, err := retypeWebSocketMessage(rawMsg, msgType)
+	if err != nil {
+		return err
+	}
+	return client.WriteJSON(relayed)
+}
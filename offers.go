@@ -9,29 +9,109 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/satori/go.uuid"
 )
 
+// RebindMode is how the client delivers a rebind, the page doing the fetches is either framed or navigated to
+type RebindMode string
+
+const (
+	RebindModeFrame    RebindMode = "frame"    // A hidden iframe per port, fetch results come back over a MessageChannel
+	RebindModeNavigate RebindMode = "navigate" // A top-level window, for browsers that partition or block third-party frames, fetch results come back over the WebSocket
+)
+
 // RebindOffer describes a offer to rebind
 type RebindOffer struct {
-	ID  uuid.UUID `json:"id"`
-	URL string    `json:"url"`
+	ID   uuid.UUID         `json:"id"`
+	Mode RebindMode        `json:"mode"`
+	URL  string            `json:"url"`  // The page for the host's port
+	URLs map[string]string `json:"urls"` // The pages for every port of the offer (including the host's), by port
+}
+
+// maxOfferPorts is how many ports a single offer may rebind, each of them is bound on every leased address
+const maxOfferPorts = 16
+
+// offerPorts returns the ports an offer has to serve, the host's port first followed by any others requested
+// Ports are normalized (ex. "080" is "80") so the same port is never rebound twice
+func offerPorts(req WebSocketHostRequest) ([]string, error) {
+	if req.Host == nil {
+		return nil, fmt.Errorf("missing host")
+	}
+	var ports []string
+	seen := make(map[string]bool)
+	for _, port := range append([]string{req.Host.Port}, req.Ports...) {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf(`invalid port "%s" for "%s"`, port, req.Host)
+		}
+		port = strconv.Itoa(n)
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) > maxOfferPorts {
+		return nil, fmt.Errorf(`too many ports (%d) for "%s", at most %d can be rebound at once`, len(ports), req.Host, maxOfferPorts)
+	}
+	return ports, nil
+}
+
+// offerMode returns the mode the offers for a request are made in, frames unless the client asks otherwise
+func offerMode(req WebSocketHostRequest, ports []string) (RebindMode, error) {
+	switch req.Mode {
+	case "", RebindModeFrame:
+		return RebindModeFrame, nil
+	case RebindModeNavigate:
+		// A window can't reach the other ports of its host (they're other origins)
+		if len(ports) > 1 {
+			return "", fmt.Errorf(`navigation offers for "%s" can only rebind a single port`, req.Host)
+		}
+		return RebindModeNavigate, nil
+	}
+	return "", fmt.Errorf(`unknown rebind mode "%s" for "%s"`, req.Mode, req.Host)
 }
 
 // MakeOffer is responsible for setting up then "offering" multiple rebinds for a given request
-func (m *RebindManager) MakeOffer(ctx context.Context, req WebSocketHostRequest) []RebindOffer {
+// An error is returned without making any offers if the pool can't serve the target
+func (m *RebindManager) MakeOffer(ctx context.Context, req WebSocketHostRequest) ([]RebindOffer, error) {
+	ports, err := offerPorts(req)
+	if err != nil {
+		return nil, err
+	}
+	// Target the normalized port of the host
+	req.Host = req.Host.Clone()
+	req.Host.Port = ports[0]
+	mode, err := offerMode(req, ports)
+	if err != nil {
+		return nil, err
+	}
+	// Every navigation needs its own window and browsers only allow one per click, so a single method is offered
+	if mode == RebindModeNavigate {
+		// Catch port conflicts before leasing anything, the leases can still come up empty if the pool runs out meanwhile
+		if err := m.CanServe(req.Host, ports, ttlRebindPoolRequirements); err != nil {
+			return nil, err
+		}
+		return m.offerMethods(ctx, req.Host, ports, mode, []RebindMethod{
+			NewTTLRebind(ctx, m, req.Host, ports, 1),
+		})
+	}
+	if err := m.CanServe(req.Host, ports, ttlRebindPoolRequirements, thresholdRebindPoolRequirements); err != nil {
+		return nil, err
+	}
 	// TODO: Choose slightly more intelligently
 	methods := []RebindMethod{
-		NewTTLRebind(ctx, m, req.Host, 1),
-		NewTTLRebind(ctx, m, req.Host, 2),
-		NewTTLRebind(ctx, m, req.Host, 4),
-		NewTTLRebind(ctx, m, req.Host, 8),
-		NewTTLRebind(ctx, m, req.Host, 16),
-		NewThresholdRebind(ctx, m, req.Host, 1, 2),
-		NewThresholdRebind(ctx, m, req.Host, 2, 2),
-		NewThresholdRebind(ctx, m, req.Host, 3, 4),
-		NewThresholdRebind(ctx, m, req.Host, 4, 4),
+		NewTTLRebind(ctx, m, req.Host, ports, 1),
+		NewTTLRebind(ctx, m, req.Host, ports, 2),
+		NewTTLRebind(ctx, m, req.Host, ports, 4),
+		NewTTLRebind(ctx, m, req.Host, ports, 8),
+		NewTTLRebind(ctx, m, req.Host, ports, 16),
+		NewThresholdRebind(ctx, m, req.Host, ports, 1, 2),
+		NewThresholdRebind(ctx, m, req.Host, ports, 2, 2),
+		NewThresholdRebind(ctx, m, req.Host, ports, 3, 4),
+		NewThresholdRebind(ctx, m, req.Host, ports, 4, 4),
 		/*
 			&ThresholdRebind{
 				Target:    req.Host,
@@ -86,18 +166,55 @@ func (m *RebindManager) MakeOffer(ctx context.Context, req WebSocketHostRequest)
 			break
 		}
 	}*/
+	return m.offerMethods(ctx, req.Host, ports, RebindModeFrame, methods)
+}
+
+// offerMethods registers each of the methods that leased a server as a rebind and returns their offers
+// An error is returned if none of them did, the pool can run out between CanServe and the leases
+func (m *RebindManager) offerMethods(ctx context.Context, target *Address, ports []string, mode RebindMode, methods []RebindMethod) ([]RebindOffer, error) {
 	// Loop each method and configure
 	var offers []RebindOffer
 	for _, method := range methods {
+		if !method.Leased() {
+			log.Debugf(`Dropped rebind method of type "%s" for request "%s", no server was leased`, reflect.TypeOf(method), requestID(ctx))
+			continue
+		}
 		id := uuid.NewV4()
-		offers = append(offers, RebindOffer{
-			ID:  id,
-			URL: fmt.Sprintf("http://%s.%s:%s/.well-known/rebind/v1.frame", id, m.base, req.Host.Port),
-		})
+		offer := RebindOffer{
+			ID:   id,
+			Mode: mode,
+			URLs: make(map[string]string),
+		}
+		path := framePath
+		if mode == RebindModeNavigate {
+			path = navigatePath
+		}
+		for _, port := range ports {
+			offer.URLs[port] = fmt.Sprintf("http://%s.%s:%s%s", id, m.base, port, path)
+		}
+		offer.URL = offer.URLs[target.Port]
+		offers = append(offers, offer)
 		m.RebindsLock.Lock()
 		m.Rebinds[id] = method
+		m.RebindOrigins[id] = rebindOrigin{
+			Socket:  socketID(ctx),
+			Request: requestID(ctx),
+			Mode:    mode,
+		}
 		m.RebindsLock.Unlock()
-		log.Infof(`Created rebind offer "%s" of type "%s" for request "%s"`, id, reflect.TypeOf(method), requestID(ctx))
+		log.Infof(`Created rebind offer "%s" of type "%s" (%s) for request "%s"`, id, reflect.TypeOf(method), mode, requestID(ctx))
+		// The rebind lives as long as the socket it was offered to, same as the servers it leased
+		go func(id uuid.UUID) {
+			<-ctx.Done()
+			m.RebindsLock.Lock()
+			delete(m.Rebinds, id)
+			delete(m.RebindOrigins, id)
+			m.RebindsLock.Unlock()
+			log.Debugf(`Removed rebind offer "%s"`, id)
+		}(id)
+	}
+	if len(offers) == 0 {
+		return nil, fmt.Errorf(`no address in the pool could be leased to serve port(s) %s for "%s"`, strings.Join(ports, ","), target)
 	}
-	return offers
+	return offers, nil
 }
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOfferPorts(t *testing.T) {
+	tests := []struct {
+		host  string // "" sends no host at all
+		ports []string
+		want  []string // nil if the request should be rejected
+	}{
+		{"192.168.1.1:80", nil, []string{"80"}},
+		{"192.168.1.1:80", []string{"443", "8080"}, []string{"80", "443", "8080"}},
+		{"192.168.1.1:080", []string{"0443"}, []string{"80", "443"}},
+		{"192.168.1.1:80", []string{"080", "443", "+443"}, []string{"80", "443"}}, // Duplicates once normalized
+		{"192.168.1.1:0", nil, nil},
+		{"192.168.1.1:65536", nil, nil},
+		{"192.168.1.1:http", nil, nil},
+		{"192.168.1.1:80", []string{"0"}, nil},
+		{"192.168.1.1:80", []string{"65536"}, nil},
+		{"192.168.1.1:80", []string{""}, nil},
+		{"192.168.1.1:80", []string{"1-2"}, nil},
+		{"192.168.1.1:1", []string{"2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15", "16"}, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15", "16"}},
+		{"192.168.1.1:1", []string{"2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15", "16", "17"}, nil}, // Too many
+		{"", []string{"80"}, nil},
+	}
+	for _, test := range tests {
+		var host *Address
+		if test.host != "" {
+			host = NewAddress(test.host)
+		}
+		ports, err := offerPorts(WebSocketHostRequest{Host: host, Ports: test.ports})
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s %v: expected an error, got %v", test.host, test.ports, ports)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(ports, test.want) {
+			t.Errorf("%s %v: expected %v, got %v (%v)", test.host, test.ports, test.want, ports, err)
+		}
+	}
+}
+
+func TestOfferMethodsForgetsRebindsWithTheSocket(t *testing.T) {
+	m := NewRebindManager("rebind.test", nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	offers, err := m.offerMethods(ctx, NewAddress("192.168.1.1:80"), []string{"80"}, RebindModeFrame, []RebindMethod{&MultiRecordRebind{v4Server: &HTTPServer{}}, &MultiRecordRebind{v6Server: &HTTPServer{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// count returns how many of the offers are still known
+	count := func() (rebinds int, origins int) {
+		m.RebindsLock.RLock()
+		defer m.RebindsLock.RUnlock()
+		for _, offer := range offers {
+			if _, ok := m.Rebinds[offer.ID]; ok {
+				rebinds++
+			}
+			if _, ok := m.RebindOrigins[offer.ID]; ok {
+				origins++
+			}
+		}
+		return
+	}
+	if rebinds, origins := count(); rebinds != 2 || origins != 2 {
+		t.Fatalf("expected both offers to be registered, got %d rebinds and %d origins", rebinds, origins)
+	}
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		rebinds, origins := count()
+		if rebinds == 0 && origins == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the offers to be forgotten once the socket closed, %d rebinds and %d origins are left", rebinds, origins)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOfferMethodsDropsUnleasedMethods(t *testing.T) {
+	m := NewRebindManager("rebind.test", nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := NewAddress("192.168.1.1:80")
+	offers, err := m.offerMethods(ctx, target, []string{"80"}, RebindModeFrame, []RebindMethod{&MultiRecordRebind{}, &MultiRecordRebind{v4Server: &HTTPServer{}}, &TTLRebind{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offers) != 1 {
+		t.Fatalf("expected only the method with a server to be offered, got %d offers", len(offers))
+	}
+	if offers, err := m.offerMethods(ctx, target, []string{"80"}, RebindModeFrame, []RebindMethod{&TTLRebind{}, &ThresholdRebind{}}); err == nil {
+		t.Fatalf("expected an error when no method leased a server, got %d offers", len(offers))
+	}
+	m.RebindsLock.RLock()
+	defer m.RebindsLock.RUnlock()
+	if len(m.Rebinds) != 1 || len(m.RebindOrigins) != 1 {
+		t.Fatalf("expected only the offered method to be registered, got %d rebinds and %d origins", len(m.Rebinds), len(m.RebindOrigins))
+	}
+}
+
+func TestCanServeUsesTheMethodsTags(t *testing.T) {
+	dedicated := NewAddress("10.0.0.1")
+	dedicated.Tag = poolTagDedicated
+	m := NewRebindManager("rebind.test", []*Address{dedicated}, nil)
+	target := NewAddress("192.168.1.1:80")
+	if err := m.CanServe(target, []string{"80"}, ttlRebindPoolRequirements, thresholdRebindPoolRequirements); err == nil {
+		t.Fatal("expected the untagged methods not to be servable from a dedicated address")
+	}
+	if err := m.CanServe(target, []string{"80"}, multiRecordRebindPoolRequirements); err != nil {
+		t.Fatalf("expected the dedicated address to serve its named pool: %v", err)
+	}
+	untagged := NewRebindManager("rebind.test", []*Address{NewAddress("10.0.0.2")}, nil)
+	if err := untagged.CanServe(target, []string{"80"}, multiRecordRebindPoolRequirements); err != nil {
+		t.Fatalf("expected the named pool to fall back to untagged addresses: %v", err)
+	}
+	if err := untagged.CanServe(target, []string{"80"}, PoolRequirements{Tag: poolTagDedicated}); err == nil {
+		t.Fatal("expected a named pool without fallback not to be servable from untagged addresses")
+	}
+}
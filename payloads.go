@@ -0,0 +1,175 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Payloads are operator provided files (test pages, scripts using DNSRebind) served from the main binds under payloadPath
+// Files ending in .tmpl are rendered with text/template (and served without the suffix), anything client controlled must go through the js or html escaping functions
+
+// payloadPath is the path payloads are served under
+const payloadPath = "/payloads/"
+
+// payloadTemplateSuffix marks payloads that are rendered as templates
+const payloadTemplateSuffix = ".tmpl"
+
+// Payload is a single hosted file
+type Payload struct {
+	Name        string // Served at payloadPath + Name
+	ContentType string
+	raw         []byte
+	template    *template.Template // Set if the payload is a template
+}
+
+// PayloadData is the data available to payload templates
+type PayloadData struct {
+	Base      string // The base domain rebinds are served under
+	Host      string // The host the payload was requested from (client controlled)
+	Campaign  string // The campaign ID from --payload-campaign
+	ScriptURL string // URL of the rebind library on the main bind the payload was requested from
+}
+
+// Payloads is the set of hosted payloads
+type Payloads struct {
+	payloads map[string]*Payload
+	index    *Payload // Served at "/" if set
+	campaign string
+}
+
+// NewPayloads creates an empty *Payloads instance for the campaign
+func NewPayloads(campaign string) *Payloads {
+	return &Payloads{
+		payloads: make(map[string]*Payload),
+		campaign: campaign,
+	}
+}
+
+// Add loads the file as a named payload, the content type is guessed from the extension if empty
+func (p *Payloads) Add(name string, file string, contentType string) error {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return fmt.Errorf(`invalid payload name for "%s"`, file)
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	payload := Payload{
+		Name:        strings.TrimSuffix(name, payloadTemplateSuffix),
+		ContentType: contentType,
+		raw:         raw,
+	}
+	if strings.HasSuffix(file, payloadTemplateSuffix) {
+		if payload.template, err = template.New(name).Parse(string(raw)); err != nil {
+			return fmt.Errorf(`couldn't parse payload "%s": %v`, file, err)
+		}
+	}
+	if payload.ContentType == "" {
+		payload.ContentType = mime.TypeByExtension(path.Ext(payload.Name))
+	}
+	if payload.ContentType == "" {
+		payload.ContentType = http.DetectContentType(raw)
+	}
+	if _, exists := p.payloads[payload.Name]; exists {
+		return fmt.Errorf(`payload "%s" was defined more than once`, payload.Name)
+	}
+	p.payloads[payload.Name] = &payload
+	log.Debugf(`Loaded payload "%s" from "%s" (%s)`, payload.Name, file, payload.ContentType)
+	return nil
+}
+
+// AddDir loads every file in the directory (recursively), named by their path relative to it
+func (p *Payloads) AddDir(dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		return p.Add(filepath.ToSlash(name), file, "")
+	})
+}
+
+// SetContentType overrides the content type of a payload
+func (p *Payloads) SetContentType(name string, contentType string) error {
+	payload, exists := p.payloads[name]
+	if !exists {
+		return fmt.Errorf(`payload "%s" doesn't exist`, name)
+	}
+	payload.ContentType = contentType
+	return nil
+}
+
+// SetIndex serves a payload as the landing page
+func (p *Payloads) SetIndex(name string) error {
+	payload, exists := p.payloads[name]
+	if !exists {
+		return fmt.Errorf(`payload "%s" doesn't exist`, name)
+	}
+	p.index = payload
+	return nil
+}
+
+// Serve renders a payload to the response
+func (p *Payloads) Serve(w http.ResponseWriter, payload *Payload, data *PayloadData) {
+	body := payload.raw
+	if payload.template != nil {
+		var buf bytes.Buffer
+		if err := payload.template.Execute(&buf, data); err != nil {
+			log.Errorf(`Failed to render payload "%s": %v`, payload.Name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		body = buf.Bytes()
+	}
+	w.Header().Set("Content-Type", payload.ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(body)
+}
+
+// payloadData builds the template data for a request
+// The script URL is built from the configured main bind rather than the client's Host header, with the scheme the client used
+// Behind a trusted proxy the public port isn't known so the scheme's default is assumed
+func (m *RebindManager) payloadData(req *http.Request) *PayloadData {
+	scriptURL := scriptPath
+	if bind := mainBind(req.Context()); bind != nil {
+		scheme, forwarded := m.requestScheme(req)
+		host := bind.ExternalAddr()
+		if forwarded || (scheme == "http" && bind.Port == "80") || (scheme == "https" && bind.Port == "443") {
+			host = strings.TrimSuffix(host, ":"+bind.Port)
+		}
+		scriptURL = fmt.Sprintf("%s://%s%s", scheme, host, scriptPath)
+	}
+	return &PayloadData{
+		Base:      m.base,
+		Host:      req.Host,
+		Campaign:  m.payloads.campaign,
+		ScriptURL: scriptURL,
+	}
+}
+
+// PayloadHandler serves payloads, it's only routed on the main binds (never on rebind hosts or other pool servers)
+func (m *RebindManager) PayloadHandler(w http.ResponseWriter, req *http.Request) {
+	payload, exists := m.payloads.payloads[strings.TrimPrefix(req.URL.Path, payloadPath)]
+	if !exists {
+		http.NotFound(w, req)
+		return
+	}
+	m.payloads.Serve(w, payload, m.payloadData(req))
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+)
+
+// newTestPayloads creates payloads with a single template rendering the script URL
+func newTestPayloads() *Payloads {
+	payloads := NewPayloads("campaign")
+	payloads.payloads["page.html"] = &Payload{
+		Name:        "page.html",
+		ContentType: "text/html",
+		template:    template.Must(template.New("page.html").Parse("{{.ScriptURL}}")),
+	}
+	payloads.index = payloads.payloads["page.html"]
+	return payloads
+}
+
+func TestPayloadsOnlyOnMainBinds(t *testing.T) {
+	m := NewRebindManager("rebind.test", nil, nil)
+	m.SetPayloads(newTestPayloads())
+	main := NewAddress("127.0.0.1:8080")
+	m.mainBinds[main.InternalAddr()] = main
+	tests := []struct {
+		name   string
+		addr   *Address
+		path   string
+		status int
+		body   string
+	}{
+		{"main bind payload", main, "/payloads/page.html", http.StatusOK, "http://127.0.0.1:8080/v1.js"},
+		{"main bind landing page", main, "/", http.StatusOK, "http://127.0.0.1:8080/v1.js"},
+		{"main bind shared routes", main, pingPath, http.StatusOK, "pong"},
+		{"pool server payload", NewAddress("127.0.0.2:8080"), "/payloads/page.html", http.StatusOK, "Index"},
+		{"pool server landing page", NewAddress("127.0.0.2:8080"), "/", http.StatusOK, "Index"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		// The Host header is client controlled, it must not end up in the script URL
+		m.serveHTTP(test.addr).ServeHTTP(rec, httptest.NewRequest("GET", "http://attacker.example"+test.path, nil))
+		if rec.Code != test.status || rec.Body.String() != test.body {
+			t.Errorf("%s: expected %d %q, got %d %q", test.name, test.status, test.body, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestPayloadScriptURL(t *testing.T) {
+	trusted, err := ParseIPNets([]string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		header  string // The header the proxies are configured with, "" without trusted proxies
+		bind    string
+		tls     bool
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"default port", "", "203.0.113.5:80", false, "192.0.2.1:1234", nil, "http://203.0.113.5/v1.js"},
+		{"other port", "", "203.0.113.5:8080", false, "192.0.2.1:1234", nil, "http://203.0.113.5:8080/v1.js"},
+		{"tls", "", "203.0.113.5:443", true, "192.0.2.1:1234", nil, "https://203.0.113.5/v1.js"},
+		{"ipv6", "", "[2001:db8::1]:8080", false, "192.0.2.1:1234", nil, "http://[2001:db8::1]:8080/v1.js"},
+		{"no trusted proxies", "", "203.0.113.5:8080", false, "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "http://203.0.113.5:8080/v1.js"},
+		{"trusted x-forwarded-proto", "X-Forwarded-For", "203.0.113.5:8080", false, "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "http, https"}, "https://203.0.113.5/v1.js"},
+		{"untrusted x-forwarded-proto", "X-Forwarded-For", "203.0.113.5:8080", false, "192.0.2.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "http://203.0.113.5:8080/v1.js"},
+		{"trusted forwarded", "Forwarded", "203.0.113.5:8080", false, "10.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.1;proto="https"`}, "https://203.0.113.5/v1.js"},
+		{"other header ignored", "Forwarded", "203.0.113.5:8080", false, "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "http://203.0.113.5/v1.js"},
+		{"invalid proto", "X-Forwarded-For", "203.0.113.5:8080", true, "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "javascript"}, "https://203.0.113.5/v1.js"},
+	}
+	for _, test := range tests {
+		m := NewRebindManager("rebind.test", nil, nil)
+		if test.header != "" {
+			m.SetTrustedProxies(&TrustedProxies{Forwarded: trusted, Header: test.header})
+		}
+		req := httptest.NewRequest("GET", "http://attacker.example/", nil)
+		req.RemoteAddr = test.peer
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), mainBindKey, NewAddress(test.bind)))
+		if got := m.payloadData(req).ScriptURL; got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MappingDiscovery finds the external IP an internal pool address is reachable on (ex. behind cloud 1:1 NAT)
+type MappingDiscovery interface {
+	Discover(ctx context.Context, addr *Address) (net.IP, error)
+}
+
+// MetadataDiscovery asks a metadata endpoint (ex. a cloud instance metadata service) for the external IP
+// "{internal}" in the URL is replaced with the internal IP, the response body must be the external IP
+type MetadataDiscovery struct {
+	URL    string
+	Client *http.Client
+}
+
+// Discover fetches the external IP for addr from the metadata endpoint
+func (d *MetadataDiscovery) Discover(ctx context.Context, addr *Address) (net.IP, error) {
+	url := strings.Replace(d.URL, "{internal}", addr.IP().String(), -1)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`metadata endpoint "%s" returned %s`, url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf(`metadata endpoint "%s" returned an invalid IP: %q`, url, body)
+	}
+	return ip, nil
+}
+
+// STUN (RFC 5389) constants needed for a binding request
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunMappedAddress   = 0x0001
+	stunXorMappedAddr   = 0x0020
+	stunHeaderLength    = 20
+)
+
+// STUNDiscovery sends a STUN binding request from the internal IP and uses the mapped address the server saw
+type STUNDiscovery struct {
+	Server  string // host:port of the STUN server
+	Timeout time.Duration
+}
+
+// Discover queries the STUN server from addr's internal IP
+func (d *STUNDiscovery) Discover(ctx context.Context, addr *Address) (net.IP, error) {
+	network := "udp4"
+	if addr.IP().To4() == nil {
+		network = "udp6"
+	}
+	server, err := net.ResolveUDPAddr(network, d.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: addr.IP()})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Header: type, length, magic cookie, transaction ID
+	req := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(d.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.WriteToUDP(req, server); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(resp)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore anything that isn't the response to our transaction
+		if n < stunHeaderLength || binary.BigEndian.Uint16(resp[0:2]) != stunBindingResponse || !bytes.Equal(resp[8:20], req[8:20]) {
+			continue
+		}
+		return parseSTUNMappedAddress(resp[:n])
+	}
+}
+
+// parseSTUNMappedAddress extracts the (XOR-)MAPPED-ADDRESS attribute from a binding response
+func parseSTUNMappedAddress(msg []byte) (net.IP, error) {
+	if len(msg) < stunHeaderLength {
+		return nil, errors.New("truncated STUN response")
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if stunHeaderLength+length > len(msg) {
+		return nil, errors.New("truncated STUN response")
+	}
+	var mapped net.IP
+	attrs := msg[stunHeaderLength : stunHeaderLength+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLength := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLength > len(attrs) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+		value := attrs[4 : 4+attrLength]
+		// Value: reserved, family, port, address
+		if (attrType == stunXorMappedAddr || attrType == stunMappedAddress) && len(value) >= 8 {
+			ip := make(net.IP, len(value)-4)
+			copy(ip, value[4:])
+			if attrType == stunXorMappedAddr {
+				// The address is XORed with the magic cookie followed by the transaction ID
+				for idx := range ip {
+					ip[idx] ^= msg[4+idx]
+				}
+				return ip, nil
+			}
+			mapped = ip
+		}
+		// Attributes are padded to 4 bytes
+		next := 4 + (attrLength+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, errors.New("STUN response had no mapped address")
+	}
+	return mapped, nil
+}
+
+// Discover updates the external IP of every address in the pool (except synthesized ones) using the discovery
+// Addresses that fail discovery keep their current mapping
+func (p *Pool) Discover(ctx context.Context, discovery MappingDiscovery) {
+	// Grab a snapshot so the (slow) lookups don't hold the lock
+	p.mutex.Lock()
+	var entries []*poolEntry
+	var addrs []*Address
+	for _, e := range p.entries {
+		if e.group != nil {
+			entries = append(entries, e)
+			addrs = append(addrs, e.addr)
+		}
+	}
+	p.mutex.Unlock()
+	for idx, e := range entries {
+		addr := addrs[idx]
+		external, err := discovery.Discover(ctx, addr)
+		if err != nil {
+			log.Warnf("Couldn't discover the external IP of %s: %v", addr, err)
+			continue
+		}
+		p.mutex.Lock()
+		p.remap(e, external)
+		p.mutex.Unlock()
+	}
+}
+
+// MonitorDiscovery re-runs discovery on an interval until the context is cancelled
+func (p *Pool) MonitorDiscovery(ctx context.Context, discovery MappingDiscovery, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Discover(ctx, discovery)
+		}
+	}
+}
+
+// remap changes the external IP of an entry, it must be called with the lock held
+// The entry gets a new *Address so rebinds already running on the old one are unaffected, servers are shared by internal address
+// so new rebinds keep using a running server with the new external IP (see GetHTTPServer)
+func (p *Pool) remap(e *poolEntry, external net.IP) {
+	// The address may have been removed while we were looking it up
+	if p.entries[e.addr.IP().String()] != e || e.addr.ExternalIP.Equal(external) {
+		return
+	}
+	addr := e.addr.Clone()
+	addr.ExternalIP = external
+	log.Infof("Pool address %s is now mapped to %s", e.addr, external)
+	// Entries are keyed by their internal address, so the old *Address still finds the entry (ex. MarkUnhealthy from a running rebind)
+	p.unindexExternalIP(e)
+	e.addr = addr
+	p.byExternalIP[external.String()] = append(p.byExternalIP[external.String()], e)
+}
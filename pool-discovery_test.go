@@ -0,0 +1,228 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetadataDiscovery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/external/10.0.0.5":
+			w.Write([]byte("203.0.113.5\n"))
+		case "/external/10.0.0.6":
+			http.Error(w, "Not Found", http.StatusNotFound)
+		case "/external/10.0.0.7":
+			w.Write([]byte("<html>not an IP</html>"))
+		case "/external/10.0.0.8":
+			time.Sleep(time.Second)
+		}
+	}))
+	defer srv.Close()
+	d := &MetadataDiscovery{
+		URL:    srv.URL + "/external/{internal}",
+		Client: &http.Client{Timeout: 100 * time.Millisecond},
+	}
+	tests := []struct {
+		internal string
+		want     string // "" if discovery should fail
+	}{
+		{"10.0.0.5", "203.0.113.5"},
+		{"10.0.0.6", ""}, // Not found
+		{"10.0.0.7", ""}, // Malformed body
+		{"10.0.0.8", ""}, // Timeout
+	}
+	for _, test := range tests {
+		ip, err := d.Discover(context.Background(), NewAddress(test.internal))
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.internal, ip)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: expected %s, got %s (%v)", test.internal, test.want, ip, err)
+		}
+	}
+}
+
+// stunMessage builds a binding response for the transaction with the attributes (type, value)
+func stunMessage(txn []byte, attrs ...[]byte) []byte {
+	msg := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingResponse)
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	copy(msg[8:20], txn)
+	for _, attr := range attrs {
+		msg = append(msg, attr...)
+		for len(msg)%4 != 0 {
+			msg = append(msg, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-stunHeaderLength))
+	return msg
+}
+
+// stunAttr builds an attribute, XOR-MAPPED-ADDRESS values are XORed with the cookie and transaction
+func stunAttr(attrType uint16, ip net.IP, txn []byte) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = 0x01
+	if len(ip) == net.IPv6len {
+		value[1] = 0x02
+	}
+	copy(value[4:], ip)
+	if attrType == stunXorMappedAddr {
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+		copy(key[4:], txn)
+		for idx := range ip {
+			value[4+idx] ^= key[idx]
+		}
+	}
+	attr := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint16(attr[0:2], attrType)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+	return append(attr, value...)
+}
+
+func TestParseSTUNMappedAddress(t *testing.T) {
+	txn := []byte("0123456789ab")
+	v4 := net.ParseIP("203.0.113.5")
+	v6 := net.ParseIP("2001:db8::5")
+	truncatedAttr := stunMessage(txn, stunAttr(stunXorMappedAddr, v4, txn))
+	binary.BigEndian.PutUint16(truncatedAttr[stunHeaderLength+2:], 64)
+	tests := []struct {
+		name string
+		msg  []byte
+		want net.IP // nil if parsing should fail
+	}{
+		{"xor-mapped IPv4", stunMessage(txn, stunAttr(stunXorMappedAddr, v4, txn)), v4},
+		{"xor-mapped IPv6", stunMessage(txn, stunAttr(stunXorMappedAddr, v6, txn)), v6},
+		{"mapped", stunMessage(txn, stunAttr(stunMappedAddress, v4, txn)), v4},
+		{"xor-mapped preferred", stunMessage(txn, stunAttr(stunMappedAddress, net.ParseIP("198.51.100.1"), txn), stunAttr(stunXorMappedAddr, v4, txn)), v4},
+		{"unknown attributes skipped", stunMessage(txn, []byte{0x80, 0x22, 0x00, 0x03, 'a', 'b', 'c'}, stunAttr(stunXorMappedAddr, v4, txn)), v4},
+		{"no mapped address", stunMessage(txn), nil},
+		{"truncated header", stunMessage(txn)[:10], nil},
+		{"truncated body", stunMessage(txn, stunAttr(stunXorMappedAddr, v4, txn))[:stunHeaderLength+6], nil},
+		{"truncated attribute", truncatedAttr, nil},
+	}
+	for _, test := range tests {
+		ip, err := parseSTUNMappedAddress(test.msg)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, ip)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(test.want) {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.want, ip, err)
+		}
+	}
+}
+
+// stunStub answers binding requests on a local UDP port with respond, nil responses are dropped
+func stunStub(t *testing.T, respond func(req []byte) [][]byte) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, resp := range respond(append([]byte(nil), buf[:n]...)) {
+				conn.WriteToUDP(resp, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSTUNDiscovery(t *testing.T) {
+	external := net.ParseIP("203.0.113.5")
+	tests := []struct {
+		name    string
+		respond func(req []byte) [][]byte
+		want    net.IP // nil if discovery should fail
+	}{
+		{"mapped", func(req []byte) [][]byte {
+			return [][]byte{stunMessage(req[8:20], stunAttr(stunXorMappedAddr, external, req[8:20]))}
+		}, external},
+		{"other transactions ignored", func(req []byte) [][]byte {
+			return [][]byte{
+				stunMessage([]byte("someone else"), stunAttr(stunXorMappedAddr, net.ParseIP("198.51.100.1"), []byte("someone else"))),
+				[]byte("garbage"),
+				stunMessage(req[8:20], stunAttr(stunXorMappedAddr, external, req[8:20])),
+			}
+		}, external},
+		{"no answer", func(req []byte) [][]byte {
+			return nil
+		}, nil},
+		{"malformed", func(req []byte) [][]byte {
+			return [][]byte{stunMessage(req[8:20], []byte{0x00, 0x20, 0x00, 0x02, 0x00, 0x01})}
+		}, nil},
+	}
+	for _, test := range tests {
+		d := &STUNDiscovery{
+			Server:  stunStub(t, test.respond),
+			Timeout: 200 * time.Millisecond,
+		}
+		ip, err := d.Discover(context.Background(), NewAddress("127.0.0.1"))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, ip)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(test.want) {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.want, ip, err)
+		}
+	}
+}
+
+// staticDiscovery maps every address to the same external IP
+type staticDiscovery net.IP
+
+func (d staticDiscovery) Discover(ctx context.Context, addr *Address) (net.IP, error) {
+	return net.IP(d), nil
+}
+
+func TestPoolDiscoverKeepsLeasedAddressesUsable(t *testing.T) {
+	p := newTestPool("10.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leased := p.Lease(ctx, nil)
+	if leased == nil {
+		t.Fatal("expected a lease")
+	}
+	p.Discover(ctx, staticDiscovery(net.ParseIP("203.0.113.1")))
+	if status := p.Status(); len(status) != 1 || status[0].Address != `203.0.113.1\10.0.0.1:80` {
+		t.Fatalf("expected the address to be remapped, got %+v", status)
+	}
+	// The address leased before the remap still finds its entry
+	p.MarkUnhealthy(leased, errors.New("bind failed"))
+	if status := p.Status(); status[0].Healthy {
+		t.Fatal("expected the remapped address to be marked unhealthy through the old address")
+	}
+	p.MarkPortConflict(leased, "8080")
+	if status := p.Status(); len(status[0].Conflicts) != 1 {
+		t.Fatalf("expected a port conflict on the remapped address, got %+v", status[0].Conflicts)
+	}
+}
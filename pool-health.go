@@ -0,0 +1,146 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PoolHealthCheck checks that a pool address is actually usable, unhealthy addresses are kept out of leases until they recover
+type PoolHealthCheck struct {
+	SelfConnect bool          // Also connect to the address through its external IP (requires hairpin NAT when behind a bind-map)
+	Timeout     time.Duration // Timeout for the self-connect
+}
+
+// Check test binds the internal IP in its own family and optionally connects to it through the external IP
+func (c *PoolHealthCheck) Check(addr *Address) error {
+	probe := addr.Clone()
+	probe.Port = "0" // Any port will do, we only care about the IP
+	var l net.Listener
+	var err error
+	if probe.Freebind {
+		l, err = ListenFreebind(probe.InternalAddr())
+	} else if probe.IP().To4() != nil {
+		l, err = net.Listen("tcp4", probe.InternalAddr())
+	} else {
+		l, err = net.Listen("tcp6", probe.InternalAddr())
+	}
+	if err != nil {
+		return fmt.Errorf("test bind failed: %v", err)
+	}
+	defer l.Close()
+	if !c.SelfConnect {
+		return nil
+	}
+	// Connect back to ourselves through the external IP on the port we were given
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return err
+	}
+	probe.Port = port
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := net.DialTimeout("tcp", probe.ExternalAddr(), c.Timeout)
+	if err != nil {
+		return fmt.Errorf("self-connect through %s failed: %v", probe.ExternalAddr(), err)
+	}
+	conn.Close()
+	select {
+	case err := <-accepted:
+		return err
+	case <-time.After(c.Timeout):
+		return fmt.Errorf("self-connect through %s reached somebody else", probe.ExternalAddr())
+	}
+}
+
+// SetHealthCheck configures the check used for addresses in the pool, including those added at runtime
+func (p *Pool) SetHealthCheck(check *PoolHealthCheck) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.healthCheck = check
+}
+
+// CheckHealth checks every address in the pool (except synthesized ones), updating which addresses may be leased
+func (p *Pool) CheckHealth() {
+	// Grab a snapshot so the (slow) checks don't hold the lock
+	p.mutex.Lock()
+	check := p.healthCheck
+	var entries []*poolEntry
+	var addrs []*Address
+	for _, e := range p.entries {
+		if e.group != nil {
+			entries = append(entries, e)
+			addrs = append(addrs, e.addr)
+		}
+	}
+	p.mutex.Unlock()
+	if check == nil {
+		return
+	}
+	for idx, e := range entries {
+		err := check.Check(addrs[idx])
+		p.mutex.Lock()
+		p.setHealth(e, err)
+		p.mutex.Unlock()
+	}
+}
+
+// MonitorHealth re-checks the pool on an interval until the context is cancelled
+func (p *Pool) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.CheckHealth()
+		}
+	}
+}
+
+// MarkUnhealthy excludes an address from leases after it failed outside of a health check (ex. a HTTP server couldn't bind it)
+// The next health check decides whether it has recovered
+func (p *Pool) MarkUnhealthy(addr *Address, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e, exists := p.entries[addr.IP().String()]
+	if !exists {
+		return
+	}
+	p.setHealth(e, err)
+}
+
+// setHealth records the result of a check, moving the entry in or out of the index, it must be called with the lock held
+func (p *Pool) setHealth(e *poolEntry, err error) {
+	// The address may have been removed while we were checking it
+	if p.entries[e.addr.IP().String()] != e {
+		return
+	}
+	wasHealthy := e.health == nil
+	if e.group != nil {
+		e.group.detach(e)
+	}
+	e.health = err
+	e.checked = time.Now()
+	if e.group != nil {
+		e.group.insert(e)
+	}
+	if err != nil && wasHealthy {
+		log.Warnf("Pool address %s is unhealthy, excluding it from leases: %v", e.addr, err)
+	} else if err == nil && !wasHealthy {
+		log.Infof("Pool address %s has recovered", e.addr)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// The pool index keeps addresses grouped by family and tag and bucketed by their current lease count so a lease never has to scan
+// the whole pool. Buckets are unordered slices where every entry knows its own position, making add/remove/random pick O(1).
+// Family, tag and external IP are answered by the index, and the buckets order entries for the least leased policy. Port ranges, port conflicts and any
+// other criteria are checked on the picked entry instead, a lease only falls back to scanning the narrowed buckets when
+// poolRandomAttempts random picks in a row fail them (ex. most of the pool can't bind the port). Round robin walks the
+// group order from its cursor, which is also linear when long runs of addresses are ineligible.
+
+// poolPortConflictTTL is how long a port conflict keeps an address from being leased for that port
+const poolPortConflictTTL = time.Minute
+
+// poolRandomAttempts is how many random picks are tried before falling back to scanning for an eligible address
+const poolRandomAttempts = 16
+
+// poolEntry is the index record for a single address
+type poolEntry struct {
+	addr      *Address
+	leases    []*PoolLease
+	group     *poolGroup           // nil for synthesized addresses, they're never handed out twice
+	bucket    int                  // Lease count bucket the entry is stored in, -1 if it's not in any bucket
+	pos       int                  // Position within the bucket
+	orderPos  int                  // Position within the group's order
+	draining  bool                 // Draining entries take no new leases
+	removing  bool                 // Removing entries are dropped from the pool once drained
+	ports     map[string]int       // Number of leases per port
+	conflicts map[string]time.Time // Ports found to be in use by something else, and when
+	health    error                // The result of the last health check, nil if healthy
+	checked   time.Time            // When the last health check ran
+}
+
+// conflicted returns true if the port was recently found to be in use by something else
+func (e *poolEntry) conflicted(port string) bool {
+	at, exists := e.conflicts[port]
+	return exists && time.Since(at) < poolPortConflictTTL
+}
+
+// blocked returns true if the entry can't take any new leases (draining or unhealthy)
+func (e *poolEntry) blocked() bool {
+	return e.draining || e.health != nil
+}
+
+// poolGroupKey identifies a group of addresses that are interchangeable from the index's point of view
+type poolGroupKey struct {
+	ipv6 bool
+	tag  string
+}
+
+// poolGroup holds the addresses of a single group
+type poolGroup struct {
+	key     poolGroupKey
+	buckets [][]*poolEntry // buckets[n] holds the entries with exactly n leases, blocked entries are kept out of every bucket
+	order   []*poolEntry   // Insertion order for round robin, removed entries are left as nil until compacted
+	removed int            // Number of nil entries in order
+}
+
+// insert adds the entry to the bucket matching its lease count
+func (g *poolGroup) insert(e *poolEntry) {
+	if e.blocked() {
+		e.bucket = -1
+		return
+	}
+	n := len(e.leases)
+	for len(g.buckets) <= n {
+		g.buckets = append(g.buckets, nil)
+	}
+	e.bucket = n
+	e.pos = len(g.buckets[n])
+	g.buckets[n] = append(g.buckets[n], e)
+}
+
+// detach removes the entry from whatever bucket it's in
+func (g *poolGroup) detach(e *poolEntry) {
+	if e.bucket < 0 {
+		return
+	}
+	bucket := g.buckets[e.bucket]
+	last := bucket[len(bucket)-1]
+	bucket[e.pos] = last
+	last.pos = e.pos
+	bucket[len(bucket)-1] = nil
+	g.buckets[e.bucket] = bucket[:len(bucket)-1]
+	e.bucket = -1
+}
+
+// append adds the entry to the round robin order
+func (g *poolGroup) append(e *poolEntry) {
+	e.orderPos = len(g.order)
+	g.order = append(g.order, e)
+}
+
+// drop removes the entry from the round robin order, compacting once half of it is empty
+func (g *poolGroup) drop(e *poolEntry) {
+	g.order[e.orderPos] = nil
+	g.removed++
+	if g.removed*2 < len(g.order) {
+		return
+	}
+	order := make([]*poolEntry, 0, len(g.order)-g.removed)
+	for _, entry := range g.order {
+		if entry != nil {
+			entry.orderPos = len(order)
+			order = append(order, entry)
+		}
+	}
+	g.order = order
+	g.removed = 0
+}
+
+// poolQuery narrows down the part of the index a lease has to look at
+type poolQuery struct {
+	ipv4       bool     // IPv4 groups may be used
+	ipv6       bool     // IPv6 groups may be used
+	externalIP net.IP   // Only entries with this external IP, nil for any
+	ports      []string // The ports the lease is for, empty if unknown
+	tagged     bool     // Only groups with the tag may be used
+	tag        string
+}
+
+// poolIndexHint is implemented by criteria the index can answer without checking every address
+type poolIndexHint interface {
+	narrow(*poolQuery)
+}
+
+// narrow limits the query to the groups of the family
+func (c *PoolCriteriaAddressFamily) narrow(q *poolQuery) {
+	q.ipv4 = q.ipv4 && !c.IPv6
+	q.ipv6 = q.ipv6 && c.IPv6
+}
+
+// narrow limits the query to the addresses with the external IP
+func (c *PoolCriteriaExternalIPMatch) narrow(q *poolQuery) {
+	q.externalIP = c.Addr.ExternalIP
+}
+
+// narrow records the port the lease is for so conflicting entries are skipped
+func (c *PoolCriteriaPort) narrow(q *poolQuery) {
+	q.ports = append(q.ports, c.Port)
+}
+
+// narrow limits the query to the groups with the tag
+func (c *PoolCriteriaTag) narrow(q *poolQuery) {
+	q.tagged = true
+	q.tag = c.Tag
+}
+
+// poolView implements PoolCandidates over the index for a single call to Lease, it's only valid while the pool is locked
+type poolView struct {
+	pool         *Pool
+	query        poolQuery
+	criteriaList []PoolCriteria
+}
+
+// newPoolView creates a view of the pool narrowed down by any criteria that support it
+func newPoolView(p *Pool, criteriaList []PoolCriteria) *poolView {
+	v := &poolView{
+		pool:         p,
+		query:        poolQuery{ipv4: true, ipv6: true},
+		criteriaList: criteriaList,
+	}
+	for _, criteria := range criteriaList {
+		if hint, ok := criteria.(poolIndexHint); ok {
+			hint.narrow(&v.query)
+		}
+	}
+	return v
+}
+
+// groups returns the groups matching the query
+func (v *poolView) groups() (groups []*poolGroup) {
+	for _, g := range v.pool.groups {
+		if v.matches(g) {
+			groups = append(groups, g)
+		}
+	}
+	return
+}
+
+// matches returns true if the group's family and tag match the query
+func (v *poolView) matches(g *poolGroup) bool {
+	if v.query.tagged && g.key.tag != v.query.tag {
+		return false
+	}
+	return (g.key.ipv6 && v.query.ipv6) || (!g.key.ipv6 && v.query.ipv4)
+}
+
+// levels returns the buckets the query may select from, grouped by lease count (lowest first)
+func (v *poolView) levels() (levels [][][]*poolEntry) {
+	if v.query.externalIP != nil {
+		return [][][]*poolEntry{{v.pool.byExternalIP[v.query.externalIP.String()]}}
+	}
+	groups := v.groups()
+	for n := 0; ; n++ {
+		var level [][]*poolEntry
+		more := false
+		for _, g := range groups {
+			if n < len(g.buckets) {
+				level = append(level, g.buckets[n])
+				more = true
+			}
+		}
+		if !more {
+			break
+		}
+		levels = append(levels, level)
+	}
+	return
+}
+
+// eligible checks an entry against the query and every criteria
+func (v *poolView) eligible(e *poolEntry) bool {
+	if e == nil || e.group == nil || e.blocked() {
+		return false
+	}
+	if !v.matches(e.group) {
+		return false
+	}
+	for _, port := range v.query.ports {
+		if e.conflicted(port) {
+			return false
+		}
+	}
+	return eligibleAll(v.criteriaList, e.leases, e.addr)
+}
+
+// pick selects a random eligible entry out of the slices, trying random positions first and only scanning as a fallback
+// The scan is O(n) in the size of the slices, it's only reached when criteria the index can't answer reject most of them
+func (v *poolView) pick(slices [][]*poolEntry) *Address {
+	total := 0
+	for _, s := range slices {
+		total += len(s)
+	}
+	if total == 0 {
+		return nil
+	}
+	for attempt := 0; attempt < poolRandomAttempts; attempt++ {
+		idx := rand.Intn(total)
+		for _, s := range slices {
+			if idx < len(s) {
+				if v.eligible(s[idx]) {
+					return s[idx].addr
+				}
+				break
+			}
+			idx -= len(s)
+		}
+	}
+	var eligible []*poolEntry
+	for _, s := range slices {
+		for _, e := range s {
+			if v.eligible(e) {
+				eligible = append(eligible, e)
+			}
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	return eligible[rand.Intn(len(eligible))].addr
+}
+
+// Random returns a uniformly random eligible address
+func (v *poolView) Random() *Address {
+	var slices [][]*poolEntry
+	for _, level := range v.levels() {
+		slices = append(slices, level...)
+	}
+	return v.pick(slices)
+}
+
+// LeastLeased returns a random eligible address out of those with the fewest leases
+func (v *poolView) LeastLeased() *Address {
+	for _, level := range v.levels() {
+		if addr := v.pick(level); addr != nil {
+			return addr
+		}
+	}
+	return nil
+}
+
+// Next returns the first eligible address at or after cursor in pool order, wrapping around
+func (v *poolView) Next(cursor uint64) *Address {
+	if v.query.externalIP != nil {
+		return v.pick([][]*poolEntry{v.pool.byExternalIP[v.query.externalIP.String()]})
+	}
+	groups := v.groups()
+	total := 0
+	for _, g := range groups {
+		total += len(g.order)
+	}
+	if total == 0 {
+		return nil
+	}
+	start := int(cursor % uint64(total))
+	for offset := 0; offset < total; offset++ {
+		idx := (start + offset) % total
+		for _, g := range groups {
+			if idx < len(g.order) {
+				if v.eligible(g.order[idx]) {
+					return g.order[idx].addr
+				}
+				break
+			}
+			idx -= len(g.order)
+		}
+	}
+	return nil
+}
+
+// Held returns the eligible addresses the client already holds a lease on
+func (v *poolView) Held(client string) (held []*Address) {
+	for e := range v.pool.clients[client] {
+		if v.eligible(e) {
+			held = append(held, e.addr)
+		}
+	}
+	return
+}
+
+// HeldCount returns the number of addresses the client holds a lease on
+func (v *poolView) HeldCount(client string) int {
+	return len(v.pool.clients[client])
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+// PoolCandidates gives a policy indexed access to the addresses eligible for a lease, every method returns nil if nothing is eligible
+type PoolCandidates interface {
+	Random() *Address              // A uniformly random eligible address
+	LeastLeased() *Address         // A random eligible address out of those with the fewest leases
+	Next(cursor uint64) *Address   // The first eligible address at or after cursor in pool order
+	Held(client string) []*Address // The eligible addresses a client (see clientKey and socketKey) already holds a lease on
+	HeldCount(client string) int   // The number of addresses a client holds a lease on, eligible or not
+}
+
+// PoolPolicy decides which of the eligible addresses should be leased
+// Select is always called while the pool is locked
+type PoolPolicy interface {
+	Select(context.Context, PoolCandidates) *Address
+}
+
+// ParsePoolPolicy creates a policy from its name (random, least-leased, round-robin or sticky)
+func ParsePoolPolicy(name string) (PoolPolicy, error) {
+	switch name {
+	case "random":
+		return &PoolPolicyRandom{}, nil
+	case "least-leased":
+		return &PoolPolicyLeastLeased{}, nil
+	case "round-robin":
+		return &PoolPolicyRoundRobin{}, nil
+	case "sticky":
+		return &PoolPolicySticky{}, nil
+	}
+	return nil, fmt.Errorf(`unknown pool policy "%s"`, name)
+}
+
+// PoolPolicyRandom picks one of the eligible addresses at random
+type PoolPolicyRandom struct{}
+
+// Select picks a random candidate
+func (p *PoolPolicyRandom) Select(ctx context.Context, candidates PoolCandidates) *Address {
+	return candidates.Random()
+}
+
+// PoolPolicyLeastLeased picks the address with the fewest active leases, breaking ties at random
+type PoolPolicyLeastLeased struct{}
+
+// Select picks a random candidate out of those with the fewest leases
+func (p *PoolPolicyLeastLeased) Select(ctx context.Context, candidates PoolCandidates) *Address {
+	return candidates.LeastLeased()
+}
+
+// PoolPolicyRoundRobin cycles through the eligible addresses in pool order
+type PoolPolicyRoundRobin struct {
+	next uint64 // Incremented on every selection, shared between pools so it's updated atomically
+}
+
+// Select picks the next candidate in the rotation
+func (p *PoolPolicyRoundRobin) Select(ctx context.Context, candidates PoolCandidates) *Address {
+	return candidates.Next(atomic.AddUint64(&p.next, 1) - 1)
+}
+
+// PoolPolicySticky keeps a client on the same address, preferring addresses the client already holds a lease on
+// Clients without a known address fall back to their socket
+type PoolPolicySticky struct{}
+
+// Select picks an address already leased to the client, otherwise one derived from a hash of the client
+func (p *PoolPolicySticky) Select(ctx context.Context, candidates PoolCandidates) *Address {
+	client := clientKey(ctx)
+	if held := candidates.Held(client); len(held) > 0 {
+		return held[0]
+	}
+	h := fnv.New64a()
+	h.Write([]byte(client))
+	return candidates.Next(h.Sum64())
+}
+
+// PoolPolicyAffinity keeps the addresses shown to a single client down to Spread, reusing addresses it already holds
+// Until the client holds Spread addresses (or if none of them are eligible) the fallback policy picks a new one
+type PoolPolicyAffinity struct {
+	Spread   int        // The number of addresses a client is spread across
+	BySocket bool       // Group clients by socket instead of by IP
+	Fallback PoolPolicy // Policy picking new addresses
+}
+
+// Select picks one of the client's addresses if it's already spread far enough, otherwise a new one
+// The spread counts every address the client holds, so one that's busy (ex. a port conflict) doesn't make room for another
+func (p *PoolPolicyAffinity) Select(ctx context.Context, candidates PoolCandidates) *Address {
+	client := clientKey(ctx)
+	if p.BySocket {
+		client = socketKey(ctx)
+	}
+	if held := candidates.Held(client); len(held) > 0 && candidates.HeldCount(client) >= p.Spread {
+		return held[rand.Intn(len(held))]
+	}
+	return p.Fallback.Select(ctx, candidates)
+}
+
+// leaseClients returns every key a lease is indexed under for Held
+func leaseClients(ctx context.Context) []string {
+	if clientIP(ctx) == "" {
+		return []string{socketKey(ctx)}
+	}
+	return []string{clientKey(ctx), socketKey(ctx)}
+}
+
+// socketKey identifies the socket behind a context
+func socketKey(ctx context.Context) string {
+	return socketID(ctx).String()
+}
+
+// clientKey identifies the client behind a context, by IP if known otherwise by socket
+func clientKey(ctx context.Context) string {
+	if ip := clientIP(ctx); ip != "" {
+		return ip
+	}
+	return socketKey(ctx)
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"net"
+)
+
+// PoolPrefix is a routed prefix (ex. an IPv6 /64) that pool addresses are synthesized from on demand
+// The host must either route the whole prefix locally (AnyIP: "ip -6 route add local 2001:db8::/64 dev lo") or bind with IP_FREEBIND
+type PoolPrefix struct {
+	Net      *net.IPNet // The prefix addresses are synthesized from
+	Freebind bool       // Bind synthesized addresses with IP_FREEBIND instead of relying on an AnyIP route
+	Ports    PortRanges // Ports synthesized addresses may be bound to, nil for any
+	Tag      string     // The named pool synthesized addresses belong to, "" for the default
+	BindMap  *BindMap   // The mapping covering the prefix, synthesized addresses get their external IP from it
+}
+
+// NewPoolPrefix creates a *PoolPrefix instance from CIDR notation (ex. 2001:db8::/64)
+func NewPoolPrefix(rawPrefix string, freebind bool) *PoolPrefix {
+	_, ipNet, err := net.ParseCIDR(rawPrefix)
+	if err != nil {
+		log.Errorf(`Failed to parse prefix "%s": %v`, rawPrefix, err)
+		return nil
+	}
+	return &PoolPrefix{
+		Net:      ipNet,
+		Freebind: freebind,
+	}
+}
+
+// IPv6 returns true if the prefix is an IPv6 prefix
+func (p *PoolPrefix) IPv6() bool {
+	return p.Net.IP.To4() == nil
+}
+
+// Synthesize creates a random *Address within the prefix, never returning the network address itself (nor the broadcast address of IPv4 prefixes)
+func (p *PoolPrefix) Synthesize() *Address {
+	network := p.Net.IP
+	if !p.IPv6() {
+		network = network.To4()
+	}
+	ones, bits := p.Net.Mask.Size()
+	// Nothing to pick from in a /32 or /128, nor a /127 once the network address is excluded (or a /31 once the broadcast address is too)
+	if bits-ones < 2 {
+		return nil
+	}
+	ip := make(net.IP, len(network))
+	for {
+		rand.Read(ip)
+		allZero, allOnes := true, true
+		for idx := range ip {
+			ip[idx] = network[idx] | (ip[idx] &^ p.Net.Mask[idx])
+			if ip[idx] != network[idx] {
+				allZero = false
+			}
+			if ip[idx]|p.Net.Mask[idx] != 0xff {
+				allOnes = false
+			}
+		}
+		// IPv6 has no broadcast address, the all-ones host is a regular address there
+		if !allZero && (p.IPv6() || !allOnes) {
+			break
+		}
+	}
+	external := ip
+	if p.BindMap != nil {
+		external = p.BindMap.Map(ip)
+	}
+	return &Address{
+		Port:       "80",
+		Host:       ip.String(),
+		InternalIP: ip,
+		ExternalIP: external,
+		Freebind:   p.Freebind,
+		Ports:      p.Ports,
+		Tag:        p.Tag,
+	}
+}
+
+// String is used for logging
+func (p *PoolPrefix) String() string {
+	return p.Net.String()
+}
@@ -7,33 +7,76 @@ package main
 
 import (
 	"context"
-	"math/rand"
+	"fmt"
+	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // Pool represents a pool of addresses to use for binding to HTTP ports
+// Addresses are indexed by family and lease count (see pool-index.go) so leasing doesn't depend on the size of the pool
 type Pool struct {
-	mutex  *sync.Mutex                  // Avoid and race-conditions by just using a mutex TODO: determine performance impact
-	addrs  []*Address                   // Available addresses
-	leases map[string][]context.Context // Leases to a given context by IP TODO: can't use net.IP as key, this is potentially performance impacting
+	mutex        *sync.Mutex                   // Avoid and race-conditions by just using a mutex TODO: determine performance impact
+	entries      map[string]*poolEntry         // Every address in the pool by internal IP (unique), which survives remapping its external IP
+	groups       []*poolGroup                  // Addresses grouped by family and tag
+	byExternalIP map[string][]*poolEntry       // Addresses by external IP, used for matching bind addresses
+	clients      map[string]map[*poolEntry]int // Number of leases each client (by IP and by socket) holds per address
+	prefixes     []*PoolPrefix                 // Prefixes to synthesize fresh addresses from
+	policy       PoolPolicy                    // Policy used when the caller doesn't specify one
+	unprivileged int                           // The first port that can be bound without privileges (0 if we're privileged)
+	healthCheck  *PoolHealthCheck              // Check used for addresses in the pool, nil if disabled
 }
 
-// NewPool creates a *Pool instance given a list of available addresses
-func NewPool(addrs []*Address) *Pool {
-	leases := make(map[string][]context.Context)
-	for _, addr := range addrs {
-		leases[addr.String()] = []context.Context{}
+// PoolLease represents a single lease of an address for the duration of a context
+type PoolLease struct {
+	Context context.Context // The lease is released when this context is cancelled
+	Ports   []string        // The ports the address is leased for, empty if unknown
+	clients []string        // The client holding the lease, by IP (if known) and by socket
+}
+
+// poolSynthesizeAttempts is how many random addresses are tried before giving up on a prefix
+const poolSynthesizeAttempts = 8
+
+// NewPool creates a *Pool instance given a list of available addresses and prefixes to synthesize addresses from
+func NewPool(addrs []*Address, prefixes []*PoolPrefix) *Pool {
+	p := &Pool{
+		mutex:        new(sync.Mutex),
+		entries:      make(map[string]*poolEntry),
+		byExternalIP: make(map[string][]*poolEntry),
+		clients:      make(map[string]map[*poolEntry]int),
+		prefixes:     prefixes,
+		policy:       &PoolPolicyRandom{},
+		unprivileged: PrivilegedPortStart(),
 	}
-	return &Pool{
-		mutex:  new(sync.Mutex),
-		addrs:  addrs,
-		leases: leases,
+	for _, addr := range addrs {
+		p.add(addr, false)
 	}
+	return p
+}
+
+// PoolRequirements declares the policy and criteria a rebind method needs when leasing from the pool
+type PoolRequirements struct {
+	Policy   PoolPolicy     // Policy used to select between eligible addresses, nil uses the pool default
+	Criteria []PoolCriteria // Criteria every leased address must meet
+	Affinity bool           // Prefer addresses the client already holds (see RebindManager.SetAffinity)
+	Tag      string         // The named pool to draw from, "" for the default (untagged) addresses
+	Fallback bool           // Lease an untagged address when the named pool has no eligible one
+}
+
+// poolTagDedicated is the named pool for methods that need public IPs of their own
+const poolTagDedicated = "dedicated"
+
+// With returns the requirement's criteria with extra criteria appended, without modifying the requirements
+func (r PoolRequirements) With(extra ...PoolCriteria) []PoolCriteria {
+	criteria := make([]PoolCriteria, 0, len(r.Criteria)+len(extra))
+	criteria = append(criteria, r.Criteria...)
+	return append(criteria, extra...)
 }
 
 // PoolCriteria defines a interface that decides if a given IP is eligible
 type PoolCriteria interface {
-	Eligible([]context.Context, *Address) bool
+	Eligible([]*PoolLease, *Address) bool
 }
 
 // PoolCriteriaAddressFamily matches addresses which are in the same address family (IPv4/IPv6)
@@ -42,55 +85,425 @@ type PoolCriteriaAddressFamily struct {
 }
 
 // Eligible will only return true if the address is in the family specified earlier
-func (c *PoolCriteriaAddressFamily) Eligible(ctxs []context.Context, addr *Address) bool {
+func (c *PoolCriteriaAddressFamily) Eligible(leases []*PoolLease, addr *Address) bool {
 	return (addr.IP().To4() == nil) == c.IPv6
 }
 
-// PoolCriteriaExactMatch matches addresses which are exactly the address provided
+// PoolCriteriaExternalIPMatch matches addresses which are exactly the address provided
 type PoolCriteriaExternalIPMatch struct {
 	Addr *Address
 }
 
 // Eligible will only return true if the address exactly matches
-func (c *PoolCriteriaExternalIPMatch) Eligible(ctxs []context.Context, addr *Address) bool {
+func (c *PoolCriteriaExternalIPMatch) Eligible(leases []*PoolLease, addr *Address) bool {
 	return addr.ExternalIP.Equal(c.Addr.ExternalIP)
 }
 
+// PoolCriteriaTag matches addresses in a named pool ("" matches the default, untagged, addresses)
+type PoolCriteriaTag struct {
+	Tag string
+}
+
+// Eligible will only return true if the address has the tag
+func (c *PoolCriteriaTag) Eligible(leases []*PoolLease, addr *Address) bool {
+	return addr.Tag == c.Tag
+}
+
+// PoolCriteriaPort matches addresses which may be bound to the port, both by their configured ranges and our privileges
+// Addresses recently found to have the port in use by something else are skipped as well
+type PoolCriteriaPort struct {
+	Port         string
+	Unprivileged int // The first port that can be bound without privileges
+}
+
+// CriteriaPort creates a *PoolCriteriaPort for the port using the privileges of this process
+func (p *Pool) CriteriaPort(port string) *PoolCriteriaPort {
+	return &PoolCriteriaPort{
+		Port:         port,
+		Unprivileged: p.unprivileged,
+	}
+}
+
+// SetUnprivilegedPortStart overrides the first port the pool considers bindable without privileges (0 for any)
+func (p *Pool) SetUnprivilegedPortStart(start int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.unprivileged = start
+}
+
+// CriteriaPorts creates a *PoolCriteriaPort for each of the ports, an address has to be bindable on all of them
+func (p *Pool) CriteriaPorts(ports []string) []PoolCriteria {
+	criteria := make([]PoolCriteria, len(ports))
+	for idx, port := range ports {
+		criteria[idx] = p.CriteriaPort(port)
+	}
+	return criteria
+}
+
+// Eligible will only return true if the address may be bound to the port
+func (c *PoolCriteriaPort) Eligible(leases []*PoolLease, addr *Address) bool {
+	port, err := strconv.Atoi(c.Port)
+	if err != nil {
+		return false
+	}
+	return port >= c.Unprivileged && addr.Ports.Contains(port)
+}
+
 // Lease will attempt to "lease" an address that meets "criteria" for the duration of context, releasing it back into the pool when the context is cancelled
-func (p *Pool) Lease(ctx context.Context, criteriaList ...PoolCriteria) *Address {
+// The policy picks between the eligible configured addresses, a fresh address is only synthesized from a prefix when none of them are eligible
+// If policy is nil the pool's default policy is used, if no address is eligible nil is returned
+func (p *Pool) Lease(ctx context.Context, policy PoolPolicy, criteriaList ...PoolCriteria) *Address {
+	if policy == nil {
+		policy = p.policy
+	}
 	// Obtain lock
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	// Loop each address to determine eligibility
-	var eligibleAddrs []*Address
-	for _, addr := range p.addrs {
-		eligible := true
-		for _, criteria := range criteriaList {
-			if !criteria.Eligible(p.leases[addr.String()], addr) {
-				eligible = false
-			}
+	view := newPoolView(p, criteriaList)
+	// Let the policy pick one of the eligible addresses out of the index, so draining, health, conflicts and affinity apply
+	if addr := policy.Select(ctx, view); addr != nil {
+		return p.lease(ctx, p.entries[addr.IP().String()], view.query.ports)
+	}
+	// Otherwise synthesize a fresh address if any prefix can provide an eligible one
+	for _, prefix := range p.prefixes {
+		if addr := p.synthesize(prefix, criteriaList); addr != nil {
+			return p.lease(ctx, p.entries[addr.IP().String()], view.query.ports)
 		}
-		if eligible {
-			eligibleAddrs = append(eligibleAddrs, addr)
+	}
+	log.Warnf(`No eligible addresses left in the pool for request "%s" on socket "%s"`, requestID(ctx), socketID(ctx))
+	return nil
+}
+
+// Available returns true if an address meeting the criteria could currently be leased, without leasing it
+func (p *Pool) Available(criteriaList ...PoolCriteria) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, prefix := range p.prefixes {
+		if addr := prefix.Synthesize(); addr != nil && eligibleAll(criteriaList, nil, addr) {
+			return true
+		}
+	}
+	return newPoolView(p, criteriaList).Random() != nil
+}
+
+// MarkPortConflict records that the port is in use by something else on the address, skipping it for leases of that port for a while
+func (p *Pool) MarkPortConflict(addr *Address, port string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e, exists := p.entries[addr.IP().String()]
+	if !exists {
+		return
+	}
+	if e.conflicts == nil {
+		e.conflicts = make(map[string]time.Time)
+	}
+	e.conflicts[port] = time.Now()
+	log.Warnf("Port %s on %s is in use by something else, skipping it for %s", port, addr, poolPortConflictTTL)
+}
+
+// synthesize creates a new address from the prefix which meets the criteria and isn't already in the pool, it must be called with the lock held
+func (p *Pool) synthesize(prefix *PoolPrefix, criteriaList []PoolCriteria) *Address {
+	for attempt := 0; attempt < poolSynthesizeAttempts; attempt++ {
+		addr := prefix.Synthesize()
+		if addr == nil || !eligibleAll(criteriaList, nil, addr) {
+			return nil
+		}
+		if _, exists := p.entries[addr.IP().String()]; exists {
+			continue
+		}
+		log.Debugf("Synthesized %s from prefix %s", addr, prefix)
+		p.add(addr, true)
+		return addr
+	}
+	return nil
+}
+
+// add indexes a new address, synthesized addresses are kept out of the groups so they're never leased twice
+// It must be called with the lock held (or before the pool is shared)
+func (p *Pool) add(addr *Address, synthesized bool) *poolEntry {
+	e := &poolEntry{
+		addr:   addr,
+		bucket: -1,
+	}
+	p.entries[addr.IP().String()] = e
+	if synthesized {
+		return e
+	}
+	key := poolGroupKey{
+		ipv6: addr.IP().To4() == nil,
+		tag:  addr.Tag,
+	}
+	for _, g := range p.groups {
+		if g.key == key {
+			e.group = g
+		}
+	}
+	if e.group == nil {
+		e.group = &poolGroup{key: key}
+		p.groups = append(p.groups, e.group)
+	}
+	e.group.insert(e)
+	e.group.append(e)
+	external := addr.ExternalIP.String()
+	p.byExternalIP[external] = append(p.byExternalIP[external], e)
+	return e
+}
+
+// remove drops an address from the pool entirely, it must be called with the lock held
+func (p *Pool) remove(e *poolEntry) {
+	delete(p.entries, e.addr.IP().String())
+	if e.group != nil {
+		e.group.detach(e)
+		e.group.drop(e)
+		p.unindexExternalIP(e)
+	}
+	log.Debugf("Removed %s from the pool", e.addr)
+}
+
+// unindexExternalIP removes the entry from the external IP index, it must be called with the lock held
+func (p *Pool) unindexExternalIP(e *poolEntry) {
+	external := e.addr.ExternalIP.String()
+	byExternalIP := p.byExternalIP[external]
+	for idx, entry := range byExternalIP {
+		if entry == e {
+			p.byExternalIP[external] = append(byExternalIP[:idx], byExternalIP[idx+1:]...)
+			break
+		}
+	}
+	if len(p.byExternalIP[external]) == 0 {
+		delete(p.byExternalIP, external)
+	}
+}
+
+// setLeases replaces the leases on an entry, moving it to the matching bucket, it must be called with the lock held
+func (p *Pool) setLeases(e *poolEntry, leases []*PoolLease) {
+	if e.group != nil {
+		e.group.detach(e)
+	}
+	e.leases = leases
+	if e.group != nil {
+		e.group.insert(e)
+	}
+}
+
+// lease records a lease on the entry until the context is cancelled, it must be called with the lock held
+func (p *Pool) lease(ctx context.Context, e *poolEntry, ports []string) *Address {
+	log.Debugf("Leasing %s", e.addr)
+	lease := &PoolLease{
+		Context: ctx,
+		Ports:   ports,
+		clients: leaseClients(ctx),
+	}
+	p.setLeases(e, append(e.leases, lease))
+	if e.ports == nil && len(ports) > 0 {
+		e.ports = make(map[string]int)
+	}
+	for _, port := range ports {
+		e.ports[port]++
+	}
+	for _, client := range lease.clients {
+		if p.clients[client] == nil {
+			p.clients[client] = make(map[*poolEntry]int)
 		}
+		p.clients[client][e]++
 	}
-	log.Infof("Found %d eligible addresses meeting criteria: %v", len(eligibleAddrs), eligibleAddrs)
-	// Pick one of the eligible addresses at random
-	addr := eligibleAddrs[rand.Intn(len(eligibleAddrs))]
-	// Lease it
-	log.Infof("Leasing %s", addr)
-	p.leases[addr.String()] = append(p.leases[addr.String()], ctx)
 	// When the context cancels release the lease
 	go func() {
 		<-ctx.Done()
-		log.Infof("Releasing lease on %s", addr)
-		for idx, lctx := range p.leases[addr.String()] {
-			if lctx == ctx {
-				p.leases[addr.String()] = append(p.leases[addr.String()][:idx], p.leases[addr.String()][idx+1:]...)
-				break
-			}
-		}
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.release(e, lease)
 	}()
 	// Return the leased address
-	return addr
+	return e.addr
+}
+
+// release removes a lease from the entry, it must be called with the lock held
+func (p *Pool) release(e *poolEntry, lease *PoolLease) {
+	log.Debugf("Releasing lease on %s", e.addr)
+	for idx, l := range e.leases {
+		if l == lease {
+			leases := make([]*PoolLease, 0, len(e.leases)-1)
+			leases = append(leases, e.leases[:idx]...)
+			p.setLeases(e, append(leases, e.leases[idx+1:]...))
+			break
+		}
+	}
+	for _, port := range lease.Ports {
+		if e.ports[port]--; e.ports[port] <= 0 {
+			delete(e.ports, port)
+		}
+	}
+	for _, client := range lease.clients {
+		if held := p.clients[client]; held != nil {
+			if held[e]--; held[e] <= 0 {
+				delete(held, e)
+			}
+			if len(held) == 0 {
+				delete(p.clients, client)
+			}
+		}
+	}
+	// Synthesized addresses only live as long as their leases, as do addresses waiting to be removed
+	if len(e.leases) == 0 && (e.group == nil || e.removing) {
+		p.remove(e)
+	}
+}
+
+// PoolAddressStatus describes the state of a single address in the pool, used for reporting to operators
+type PoolAddressStatus struct {
+	Address     string         `json:"address"`
+	Leases      int            `json:"leases"`
+	Draining    bool           `json:"draining"`
+	Removing    bool           `json:"removing"`
+	Synthesized bool           `json:"synthesized"`
+	Tag         string         `json:"tag,omitempty"` // The named pool the address belongs to
+	Ports       string         `json:"ports"`         // The ports the address may be bound to
+	Leased      map[string]int `json:"leased"`        // Number of leases per port
+	Conflicts   []string       `json:"conflicts"`     // Ports recently found to be in use by something else
+	Healthy     bool           `json:"healthy"`
+	HealthError string         `json:"healthError,omitempty"` // Why the last health check failed
+	Checked     *time.Time     `json:"checked,omitempty"`     // When the last health check ran
+}
+
+// Add adds an address to the pool at runtime, it's health checked before it can be leased
+func (p *Pool) Add(addr *Address) error {
+	p.mutex.Lock()
+	check := p.healthCheck
+	p.mutex.Unlock()
+	var health error
+	if check != nil {
+		health = check.Check(addr)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// Addresses are identified by their internal IP, the same one behind another external IP is still a duplicate
+	if e := p.find(addr.InternalIP); e != nil {
+		return fmt.Errorf(`address "%s" is already in the pool`, e.addr)
+	}
+	p.setHealth(p.add(addr, false), health)
+	log.Infof("Added %s to the pool", addr)
+	return nil
+}
+
+// Drain stops new leases on the address with the given internal IP, existing leases run until their contexts are cancelled
+func (p *Pool) Drain(ip net.IP) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e := p.find(ip)
+	if e == nil {
+		return fmt.Errorf(`address "%s" is not in the pool`, ip)
+	}
+	p.drain(e)
+	return nil
+}
+
+// Remove drains the address with the given internal IP and drops it from the pool once the last lease is released
+// It returns true if the address was removed immediately
+func (p *Pool) Remove(ip net.IP) (bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e := p.find(ip)
+	if e == nil {
+		return false, fmt.Errorf(`address "%s" is not in the pool`, ip)
+	}
+	p.drain(e)
+	if len(e.leases) == 0 {
+		p.remove(e)
+		return true, nil
+	}
+	e.removing = true
+	log.Infof("Removing %s from the pool once its %d leases are released", e.addr, len(e.leases))
+	return false, nil
+}
+
+// Status reports the state of every address in the pool
+func (p *Pool) Status() []PoolAddressStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	status := make([]PoolAddressStatus, 0, len(p.entries))
+	for _, e := range p.entries {
+		leased := make(map[string]int, len(e.ports))
+		for port, count := range e.ports {
+			leased[port] = count
+		}
+		var conflicts []string
+		for port := range e.conflicts {
+			if e.conflicted(port) {
+				conflicts = append(conflicts, port)
+			}
+		}
+		var healthError string
+		if e.health != nil {
+			healthError = e.health.Error()
+		}
+		var checked *time.Time
+		if !e.checked.IsZero() {
+			at := e.checked
+			checked = &at
+		}
+		status = append(status, PoolAddressStatus{
+			Address:     e.addr.String(),
+			Leases:      len(e.leases),
+			Draining:    e.draining,
+			Removing:    e.removing,
+			Synthesized: e.group == nil,
+			Tag:         e.addr.Tag,
+			Ports:       e.addr.Ports.String(),
+			Leased:      leased,
+			Conflicts:   conflicts,
+			Healthy:     e.health == nil,
+			HealthError: healthError,
+			Checked:     checked,
+		})
+	}
+	return status
+}
+
+// Configured returns the configured (not synthesized) addresses that can currently be leased, skipping draining and unhealthy ones
+func (p *Pool) Configured() []*Address {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var addrs []*Address
+	for _, e := range p.entries {
+		if e.group != nil && !e.draining && e.health == nil {
+			addrs = append(addrs, e.addr)
+		}
+	}
+	return addrs
+}
+
+// IsConfigured returns true if the address with the internal IP is configured (not synthesized), not draining and healthy
+func (p *Pool) IsConfigured(ip net.IP) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e := p.find(ip)
+	return e != nil && e.group != nil && !e.draining && e.health == nil
+}
+
+// find returns the entry with the given internal IP, it must be called with the lock held
+func (p *Pool) find(ip net.IP) *poolEntry {
+	return p.entries[ip.String()]
+}
+
+// drain marks the entry as draining and takes it out of the index, it must be called with the lock held
+func (p *Pool) drain(e *poolEntry) {
+	if e.draining {
+		return
+	}
+	e.draining = true
+	if e.group != nil {
+		e.group.detach(e)
+	}
+	log.Infof("Draining %s, %d leases remaining", e.addr, len(e.leases))
+}
+
+// eligibleAll returns true if the address meets every criteria
+func eligibleAll(criteriaList []PoolCriteria, leases []*PoolLease, addr *Address) bool {
+	for _, criteria := range criteriaList {
+		if !criteria.Eligible(leases, addr) {
+			return false
+		}
+	}
+	return true
 }
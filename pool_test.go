@@ -0,0 +1,398 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Silence the logger, warnings about exhausted pools are expected
+func init() {
+	log.Level = logrus.ErrorLevel
+}
+
+// newBenchmarkPool creates a pool of n IPv6 addresses
+func newBenchmarkPool(b *testing.B, n int) *Pool {
+	addrs := make([]*Address, n)
+	for idx := range addrs {
+		addrs[idx] = NewAddress(fmt.Sprintf("[2001:db8::%x:%x]:80", idx>>16, idx&0xffff))
+	}
+	return NewPool(addrs, nil)
+}
+
+// benchmarkPoolLease leases and releases addresses from a pool of n addresses, keeping "held" leases alive at any time
+func benchmarkPoolLease(b *testing.B, n int, held int, policy PoolPolicy, criteria ...PoolCriteria) {
+	p := newBenchmarkPool(b, n)
+	cancels := make([]context.CancelFunc, held)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cancel := cancels[i%held]; cancel != nil {
+			cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if p.Lease(ctx, policy, criteria...) == nil {
+			b.Fatal("pool exhausted")
+		}
+		cancels[i%held] = cancel
+	}
+	b.StopTimer()
+	for _, cancel := range cancels {
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
+
+func BenchmarkPoolLeaseRandom100k(b *testing.B) {
+	benchmarkPoolLease(b, 100000, 1000, &PoolPolicyRandom{}, &PoolCriteriaAddressFamily{IPv6: true})
+}
+
+func BenchmarkPoolLeaseLeastLeased100k(b *testing.B) {
+	benchmarkPoolLease(b, 100000, 1000, &PoolPolicyLeastLeased{}, &PoolCriteriaAddressFamily{IPv6: true})
+}
+
+func BenchmarkPoolLeaseRoundRobin100k(b *testing.B) {
+	benchmarkPoolLease(b, 100000, 1000, &PoolPolicyRoundRobin{}, &PoolCriteriaAddressFamily{IPv6: true})
+}
+
+// BenchmarkPoolLeaseChurn100k leases and releases from many goroutines at once
+func BenchmarkPoolLeaseChurn100k(b *testing.B) {
+	p := newBenchmarkPool(b, 100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		cancels := make([]context.CancelFunc, 64)
+		i := 0
+		for pb.Next() {
+			if cancel := cancels[i%len(cancels)]; cancel != nil {
+				cancel()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if p.Lease(ctx, &PoolPolicyLeastLeased{}, &PoolCriteriaAddressFamily{IPv6: true}) == nil {
+				b.Fatal("pool exhausted")
+			}
+			cancels[i%len(cancels)] = cancel
+			i++
+		}
+		for _, cancel := range cancels {
+			if cancel != nil {
+				cancel()
+			}
+		}
+	})
+}
+
+func TestPoolLeasePrefersConfiguredAddresses(t *testing.T) {
+	prefix := NewPoolPrefix("2001:db8::/64", false)
+	configured := NewAddress("[2001:db8:1::1]:80")
+	configured.Ports, _ = ParsePortRanges("80")
+	p := NewPool([]*Address{configured}, []*PoolPrefix{prefix})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	family := &PoolCriteriaAddressFamily{IPv6: true}
+	// The configured address is eligible, so the policy gets it even though the prefix could synthesize one
+	if addr := p.Lease(ctx, &PoolPolicyLeastLeased{}, family); addr == nil || !addr.IP().Equal(NewAddress("[2001:db8:1::1]:80").IP()) {
+		t.Fatalf("expected the configured address, got %v", addr)
+	}
+	// It can't serve the port, so a fresh address comes out of the prefix
+	if addr := p.Lease(ctx, nil, family, &PoolCriteriaPort{Port: "8080"}); addr == nil || !prefix.Net.Contains(addr.IP()) {
+		t.Fatalf("expected an address synthesized from %s, got %v", prefix, addr)
+	}
+	// Draining the configured address sends every lease to the prefix
+	if err := p.Drain(NewAddress("[2001:db8:1::1]:80").IP()); err != nil {
+		t.Fatal(err)
+	}
+	if addr := p.Lease(ctx, nil, family); addr == nil || !prefix.Net.Contains(addr.IP()) {
+		t.Fatalf("expected an address synthesized from %s, got %v", prefix, addr)
+	}
+}
+
+// newTestPool creates a pool of addresses, "ip" or "ip=tag"
+func newTestPool(raw ...string) *Pool {
+	addrs := make([]*Address, len(raw))
+	for idx, entry := range raw {
+		parts := strings.SplitN(entry, "=", 2)
+		addrs[idx] = NewAddress(parts[0])
+		if len(parts) == 2 {
+			addrs[idx].Tag = parts[1]
+		}
+	}
+	return NewPool(addrs, nil)
+}
+
+// waitPoolLeases waits for the releases of cancelled leases (they run in the background) until the pool holds n leases in total
+func waitPoolLeases(t *testing.T, p *Pool, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		total := 0
+		for _, status := range p.Status() {
+			total += status.Leases
+		}
+		if total == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d leases, the pool holds %d", n, total)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolLeaseCriteria(t *testing.T) {
+	v4 := &PoolCriteriaAddressFamily{IPv6: false}
+	v6 := &PoolCriteriaAddressFamily{IPv6: true}
+	tests := []struct {
+		name   string
+		pool   []string
+		leases [][]PoolCriteria // Leased one after the other, every lease is held until the end of the test
+		want   []string         // The internal IP each lease gets, "" if it should fail
+	}{
+		{
+			name:   "family",
+			pool:   []string{"10.0.0.1", "[2001:db8::1]"},
+			leases: [][]PoolCriteria{{v6}, {v4}, {v6}},
+			want:   []string{"2001:db8::1", "10.0.0.1", "2001:db8::1"},
+		},
+		{
+			name:   "tag",
+			pool:   []string{"10.0.0.1", "10.0.0.2=dedicated"},
+			leases: [][]PoolCriteria{{&PoolCriteriaTag{Tag: "dedicated"}}, {&PoolCriteriaTag{}}, {&PoolCriteriaTag{Tag: "other"}}},
+			want:   []string{"10.0.0.2", "10.0.0.1", ""},
+		},
+		{
+			name:   "external IP",
+			pool:   []string{"10.0.0.1", "10.0.0.2"},
+			leases: [][]PoolCriteria{{&PoolCriteriaExternalIPMatch{Addr: NewAddress("10.0.0.2")}}, {&PoolCriteriaExternalIPMatch{Addr: NewAddress("10.0.0.3")}}},
+			want:   []string{"10.0.0.2", ""},
+		},
+		{
+			name:   "privileged ports",
+			pool:   []string{"10.0.0.1"},
+			leases: [][]PoolCriteria{{&PoolCriteriaPort{Port: "8080"}}, {&PoolCriteriaPort{Port: "80", Unprivileged: 1024}}},
+			want:   []string{"10.0.0.1", ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPool(test.pool...)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for idx, criteria := range test.leases {
+				addr := p.Lease(ctx, &PoolPolicyLeastLeased{}, criteria...)
+				got := ""
+				if addr != nil {
+					got = addr.IP().String()
+				}
+				if got != test.want[idx] {
+					t.Fatalf("lease %d: expected %q, got %q", idx, test.want[idx], got)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolLeaseRebucketsOnRelease(t *testing.T) {
+	p := newTestPool("10.0.0.1", "10.0.0.2")
+	first, releaseFirst := context.WithCancel(context.Background())
+	second, releaseSecond := context.WithCancel(context.Background())
+	defer releaseSecond()
+	a := p.Lease(first, &PoolPolicyLeastLeased{})
+	b := p.Lease(second, &PoolPolicyLeastLeased{})
+	if a == nil || b == nil || a.IP().Equal(b.IP()) {
+		t.Fatalf("expected the least leased policy to spread the leases, got %v and %v", a, b)
+	}
+	// Take a second lease on the second address
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if addr := p.Lease(ctx, nil, &PoolCriteriaExternalIPMatch{Addr: b}); addr == nil {
+		t.Fatal("expected the second address to take another lease")
+	}
+	releaseFirst()
+	waitPoolLeases(t, p, 2)
+	// The released address moved back to the empty bucket, it stays the least leased after taking one more lease
+	for idx := 0; idx < 2; idx++ {
+		if addr := p.Lease(ctx, &PoolPolicyLeastLeased{}); addr == nil || !addr.IP().Equal(a.IP()) {
+			t.Fatalf("lease %d: expected the released address, got %v", idx, addr)
+		}
+	}
+}
+
+func TestPoolDrainAndRemove(t *testing.T) {
+	p := newTestPool("10.0.0.1", "10.0.0.2")
+	ip := NewAddress("10.0.0.1").IP()
+	ctx, cancel := context.WithCancel(context.Background())
+	if addr := p.Lease(ctx, nil, &PoolCriteriaExternalIPMatch{Addr: NewAddress("10.0.0.1")}); addr == nil {
+		t.Fatal("expected a lease")
+	}
+	if err := p.Drain(ip); err != nil {
+		t.Fatal(err)
+	}
+	// Draining addresses take no new leases
+	other, cancelOther := context.WithCancel(context.Background())
+	defer cancelOther()
+	for idx := 0; idx < 8; idx++ {
+		if addr := p.Lease(other, nil); addr == nil || addr.IP().Equal(ip) {
+			t.Fatalf("expected the other address, got %v", addr)
+		}
+	}
+	// Removing waits for the last lease
+	removed, err := p.Remove(ip)
+	if err != nil || removed {
+		t.Fatalf("expected the removal to wait for the lease, got %v (%v)", removed, err)
+	}
+	if !poolContains(p, ip) {
+		t.Fatal("expected the address to stay until its lease is released")
+	}
+	cancel()
+	waitPoolLeases(t, p, 8)
+	if poolContains(p, ip) {
+		t.Fatal("expected the address to be removed once its lease was released")
+	}
+	if _, err := p.Remove(ip); err == nil {
+		t.Fatal("expected an error removing an address that's gone")
+	}
+	// Unleased addresses are removed straight away
+	cancelOther()
+	waitPoolLeases(t, p, 0)
+	if removed, err := p.Remove(NewAddress("10.0.0.2").IP()); err != nil || !removed {
+		t.Fatalf("expected the second address to be removed right away, got %v (%v)", removed, err)
+	}
+}
+
+// poolContains returns true if the pool has an address with the internal IP
+func poolContains(p *Pool, ip net.IP) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.find(ip) != nil
+}
+
+func TestPoolAddRejectsDuplicates(t *testing.T) {
+	p := newTestPool("10.0.0.1")
+	mapped := NewAddress("10.0.0.1")
+	mapped.ExternalIP = NewAddress("203.0.113.1").IP()
+	if err := p.Add(mapped); err == nil {
+		t.Fatal("expected the same internal IP behind another external IP to be rejected")
+	}
+	if err := p.Add(NewAddress("10.0.0.1:8080")); err == nil {
+		t.Fatal("expected the same internal IP on another port to be rejected")
+	}
+	if err := p.Add(NewAddress("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.Status()); n != 2 {
+		t.Fatalf("expected 2 addresses in the pool, got %d", n)
+	}
+}
+
+func TestPoolPrefixSynthesize(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []string // Every address the prefix may synthesize, nil if it can't synthesize any
+	}{
+		{"192.0.2.0/30", []string{"192.0.2.1", "192.0.2.2"}}, // Neither the network nor the broadcast address
+		{"192.0.2.8/29", []string{"192.0.2.9", "192.0.2.10", "192.0.2.11", "192.0.2.12", "192.0.2.13", "192.0.2.14"}},
+		{"2001:db8::/126", []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}}, // IPv6 has no broadcast address
+		{"192.0.2.0/31", nil},
+		{"192.0.2.1/32", nil},
+		{"2001:db8::/127", nil},
+	}
+	for _, test := range tests {
+		prefix := NewPoolPrefix(test.prefix, false)
+		if test.want == nil {
+			if addr := prefix.Synthesize(); addr != nil {
+				t.Errorf("%s: expected nothing to be synthesized, got %s", test.prefix, addr)
+			}
+			continue
+		}
+		seen := make(map[string]bool)
+		for idx := 0; idx < 200; idx++ {
+			seen[prefix.Synthesize().IP().String()] = true
+		}
+		for _, want := range test.want {
+			if !seen[want] {
+				t.Errorf("%s: expected %s to be synthesized", test.prefix, want)
+			}
+			delete(seen, want)
+		}
+		for ip := range seen {
+			t.Errorf("%s: unexpected address %s", test.prefix, ip)
+		}
+	}
+}
+
+func TestPoolIsConfigured(t *testing.T) {
+	prefix := NewPoolPrefix("2001:db8::/64", false)
+	p := NewPool([]*Address{NewAddress("10.0.0.1"), NewAddress("10.0.0.2")}, []*PoolPrefix{prefix})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	synthesized := p.Lease(ctx, nil, &PoolCriteriaAddressFamily{IPv6: true})
+	if synthesized == nil {
+		t.Fatal("expected an address synthesized from the prefix")
+	}
+	if err := p.Drain(NewAddress("10.0.0.2").IP()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.ParseIP("10.0.0.1"), true},
+		{net.ParseIP("10.0.0.1").To4(), true}, // Either form of an IPv4 address
+		{net.ParseIP("10.0.0.2"), false},      // Draining
+		{net.ParseIP("10.0.0.3"), false},
+		{synthesized.IP(), false},
+	}
+	for _, test := range tests {
+		if got := p.IsConfigured(test.ip); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.ip, test.want, got)
+		}
+	}
+}
+
+func TestPoolPolicyAffinitySpread(t *testing.T) {
+	p := newTestPool("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), clientIPKey, "192.0.2.1"))
+	defer cancel()
+	policy := &PoolPolicyAffinity{Spread: 2, Fallback: &PoolPolicyLeastLeased{}}
+	port := &PoolCriteriaPort{Port: "80"}
+	held := make(map[string]*Address)
+	for idx := 0; idx < 2; idx++ {
+		addr := p.Lease(ctx, policy, port)
+		if addr == nil {
+			t.Fatal("expected a lease")
+		}
+		held[addr.IP().String()] = addr
+	}
+	if len(held) != 2 {
+		t.Fatalf("expected the client to be spread over 2 addresses, got %d", len(held))
+	}
+	var busy, free *Address
+	for _, addr := range held {
+		if busy == nil {
+			busy = addr
+		} else {
+			free = addr
+		}
+	}
+	// One of the held addresses is busy, the client stays on the other instead of growing past its spread
+	p.MarkPortConflict(busy, "80")
+	for idx := 0; idx < 4; idx++ {
+		if addr := p.Lease(ctx, policy, port); addr == nil || !addr.IP().Equal(free.IP()) {
+			t.Fatalf("lease %d: expected the held address %s, got %v", idx, free, addr)
+		}
+	}
+	// None of them are eligible, only then does the client get a new one
+	p.MarkPortConflict(free, "80")
+	if addr := p.Lease(ctx, policy, port); addr == nil || held[addr.IP().String()] != nil {
+		t.Fatalf("expected a new address, got %v", addr)
+	}
+}
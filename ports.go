@@ -0,0 +1,74 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// PortRanges is the set of ports an address may bind, nil allows every port
+type PortRanges []PortRange
+
+// ParsePortRanges parses a comma separated list of ports and ranges (ex. "80,443,8000-9000")
+func ParsePortRanges(raw string) (PortRanges, error) {
+	var ranges PortRanges
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf(`invalid port "%s" in "%s"`, bounds[0], raw)
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf(`invalid port "%s" in "%s"`, bounds[1], raw)
+			}
+		}
+		if low < 1 || high > 65535 || low > high {
+			return nil, fmt.Errorf(`invalid port range "%s" in "%s"`, part, raw)
+		}
+		ranges = append(ranges, PortRange{Low: low, High: high})
+	}
+	return ranges, nil
+}
+
+// Contains returns true if the port is in any of the ranges (or there are no ranges at all)
+func (r PortRanges) Contains(port int) bool {
+	if r == nil {
+		return true
+	}
+	for _, pr := range r {
+		if port >= pr.Low && port <= pr.High {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the ranges the same way they're parsed
+func (r PortRanges) String() string {
+	if r == nil {
+		return "*"
+	}
+	parts := make([]string, len(r))
+	for idx, pr := range r {
+		if pr.Low == pr.High {
+			parts[idx] = strconv.Itoa(pr.Low)
+		} else {
+			parts[idx] = fmt.Sprintf("%d-%d", pr.Low, pr.High)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancers in front of the listeners can pass the client's address along with the PROXY protocol (v1 and v2)
+// Only connections from the configured sources are expected to start with a header (and must), anybody else could spoof it
+
+// proxyHeaderTimeout is how long a source gets to send the header before the connection is closed
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest a v1 header may be, including the CRLF
+const proxyV1MaxLength = 107
+
+// readProxyHeader reads a v1 or v2 header, returning the source address it carries (nil for LOCAL/UNKNOWN connections)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads the text header ("PROXY TCP4 192.0.2.1 203.0.113.1 56324 80\r\n")
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf(`invalid PROXY protocol v1 header "%s"`, strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf(`invalid PROXY protocol v1 source in "%s"`, strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 reads the binary header, any TLVs are skipped
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL connections (ex. health checks) are from the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	if header[12]&0x0f != 1 {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("PROXY protocol v2 header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("PROXY protocol v2 header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// Anything else (UDP, unix sockets, unspecified) doesn't tell us about a TCP client
+	return nil, nil
+}
+
+// proxyConn is a connection from a PROXY protocol source, the header is read on first use so Accept never blocks on it
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr // The client's address from the header, nil to use the socket's
+	err    error
+}
+
+// init reads the header, closing the connection if it's missing or takes too long
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		timer := time.AfterFunc(proxyHeaderTimeout, func() {
+			c.Conn.Close()
+		})
+		c.remote, c.err = readProxyHeader(c.reader)
+		timer.Stop()
+		if c.err != nil {
+			log.Warnf("Closing connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read reads past the header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client's address from the header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// proxyListener expects a PROXY protocol header on connections from the sources
+type proxyListener struct {
+	net.Listener
+	sources []*net.IPNet
+}
+
+// Accept wraps connections from the sources so their header is read
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !ipInNets(addr.IP, l.sources) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// ipInNets returns true if any of the networks contains the IP
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
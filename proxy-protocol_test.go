@@ -0,0 +1,103 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a v2 header with the command, family/protocol byte and payload
+func proxyV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// proxyV2Addresses builds the address block for a source and destination (IPv4 or IPv6) followed by any TLVs
+func proxyV2Addresses(src string, srcPort uint16, dst string, dstPort uint16, tlvs ...byte) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	payload := append(append([]byte(nil), srcIP...), dstIP...)
+	payload = append(payload, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	return append(payload, tlvs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := proxyV2Addresses("192.0.2.1", 56324, "203.0.113.1", 80)
+	v6 := proxyV2Addresses("2001:db8::1", 56324, "2001:db8::2", 443)
+	// PP2_TYPE_AUTHORITY ("example.com") and PP2_TYPE_NOOP
+	tlvs := proxyV2Addresses("192.0.2.1", 56324, "203.0.113.1", 80, append([]byte{0x02, 0x00, 0x0b}, append([]byte("example.com"), 0x04, 0x00, 0x00)...)...)
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // The source address, "<nil>" for LOCAL/UNKNOWN and "" if reading should fail
+	}{
+		// v1
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 203.0.113.1 56324 80\r\n"), "192.0.2.1:56324"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "<nil>"},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN 192.0.2.1 203.0.113.1 56324 80\r\n"), "<nil>"},
+		{"v1 too long", []byte("PROXY UNKNOWN " + strings.Repeat("a", proxyV1MaxLength) + "\r\n"), ""},
+		{"v1 family mismatch (IPv6 in TCP4)", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), ""},
+		{"v1 family mismatch (IPv4 in TCP6)", []byte("PROXY TCP6 192.0.2.1 203.0.113.1 56324 80\r\n"), ""},
+		{"v1 bad IP", []byte("PROXY TCP4 192.0.2 203.0.113.1 56324 80\r\n"), ""},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 203.0.113.1 65536 80\r\n"), ""},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 203.0.113.1 56324\r\n"), ""},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 203.0.113.1 56324 80\r\n"), ""},
+		{"v1 no CRLF", []byte("PROXY TCP4 192.0.2.1 203.0.113.1 56324 80"), ""},
+		// v2
+		{"v2 TCP over IPv4", proxyV2Header(1, 0x11, v4), "192.0.2.1:56324"},
+		{"v2 TCP over IPv6", proxyV2Header(1, 0x21, v6), "[2001:db8::1]:56324"},
+		{"v2 TLVs skipped", proxyV2Header(1, 0x11, tlvs), "192.0.2.1:56324"},
+		{"v2 LOCAL", proxyV2Header(0, 0x00, nil), "<nil>"},
+		{"v2 LOCAL with addresses", proxyV2Header(0, 0x11, v4), "<nil>"},
+		{"v2 UDP", proxyV2Header(1, 0x12, v4), "<nil>"},
+		{"v2 truncated payload", proxyV2Header(1, 0x11, v4)[:len(proxyV2Signature)+4+6], ""},
+		{"v2 truncated header", proxyV2Header(1, 0x11, v4)[:len(proxyV2Signature)+2], ""},
+		{"v2 short IPv4 block", proxyV2Header(1, 0x11, v4[:8]), ""},
+		{"v2 short IPv6 block", proxyV2Header(1, 0x21, v4), ""},
+		{"v2 bad version", append(append([]byte(nil), proxyV2Signature...), 0x11, 0x11, 0, 0), ""},
+		{"v2 bad command", proxyV2Header(2, 0x11, v4), ""},
+		// Neither
+		{"missing", []byte("GET / HTTP/1.1\r\n\r\n"), ""},
+		{"empty", nil, ""},
+	}
+	for _, test := range tests {
+		// Whatever follows the header must be left for the connection
+		r := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), test.header...), "GET /"...)))
+		addr, err := readProxyHeader(r)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got := "<nil>"; addr != nil {
+			got = addr.String()
+			if got != test.want {
+				t.Errorf("%s: expected %s, got %s", test.name, test.want, got)
+			}
+		} else if test.want != "<nil>" {
+			t.Errorf("%s: expected %s, got no address", test.name, test.want)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET /" {
+			t.Errorf("%s: expected the header to be consumed exactly, %q is left", test.name, rest)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies describes the proxies (load balancers, nginx) in front of the listeners, so the real client address can be recovered
+type TrustedProxies struct {
+	Protocol  []*net.IPNet // Sources that send a PROXY protocol header
+	Forwarded []*net.IPNet // Proxies whose forwarding header is believed
+	Header    string       // The forwarding header the proxies set, "Forwarded" or "X-Forwarded-For" (the default)
+}
+
+// ParseIPNets parses a list of IPs or CIDR prefixes
+func ParseIPNets(raw []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(raw))
+	for _, entry := range raw {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf(`invalid IP "%s"`, entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// SetTrustedProxies configures the proxies in front of the listeners, it must be called before Listen
+func (m *RebindManager) SetTrustedProxies(proxies *TrustedProxies) {
+	m.proxies = proxies
+}
+
+// proxyListener wraps l so connections from PROXY protocol sources have their header read
+func (m *RebindManager) proxyListener(l net.Listener) net.Listener {
+	if m.proxies == nil || len(m.proxies.Protocol) == 0 {
+		return l
+	}
+	return &proxyListener{Listener: l, sources: m.proxies.Protocol}
+}
+
+// clientMiddleware puts the client's IP into the request context, believing the forwarding headers of trusted proxies
+func (m *RebindManager) clientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ip := net.ParseIP(host)
+		if ip != nil && m.proxies != nil && len(m.proxies.Forwarded) > 0 {
+			ip = forwardedClient(forwardedHops(req.Header, m.proxies.Header), ip, m.proxies.Forwarded)
+		}
+		if ip != nil {
+			host = ip.String()
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientIPKey, host)))
+	})
+}
+
+// requestScheme returns the scheme the client used and whether a trusted proxy forwarded it
+// The proxies pass it with the forwarding header they're configured with, "proto" of Forwarded or X-Forwarded-Proto along with X-Forwarded-For
+func (m *RebindManager) requestScheme(req *http.Request) (scheme string, forwarded bool) {
+	scheme = "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if m.proxies == nil || len(m.proxies.Forwarded) == 0 {
+		return scheme, false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !ipInNets(net.ParseIP(host), m.proxies.Forwarded) {
+		return scheme, false
+	}
+	// The proxy closest to us appends last
+	proto := ""
+	if m.proxies.Header == "Forwarded" {
+		for _, value := range req.Header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "proto") {
+						proto = strings.Trim(kv[1], `"`)
+					}
+				}
+			}
+		}
+	} else {
+		for _, value := range req.Header.Values("X-Forwarded-Proto") {
+			for _, entry := range strings.Split(value, ",") {
+				proto = strings.TrimSpace(entry)
+			}
+		}
+	}
+	if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+		return proto, true
+	}
+	return scheme, true
+}
+
+// forwardedHops returns the hops of the forwarding chain from the named header ("Forwarded" or "X-Forwarded-For"), closest to the client first
+// Only the header the proxies are configured with is read, otherwise a client could send the other one to pick the chain that's believed
+func forwardedHops(header http.Header, name string) []string {
+	var hops []string
+	if name == "Forwarded" {
+		for _, value := range header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				hop := ""
+				for _, pair := range strings.Split(element, ";") {
+					if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hop = kv[1]
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	return hops
+}
+
+// forwardedClient walks the forwarding chain back from the connecting peer, returning the first address not belonging to a trusted proxy
+// An invalid hop stops the walk at the last trusted proxy
+func forwardedClient(hops []string, peer net.IP, trusted []*net.IPNet) net.IP {
+	client := peer
+	for idx := len(hops) - 1; idx >= 0 && ipInNets(client, trusted); idx-- {
+		ip := parseForwardedHop(hops[idx])
+		if ip == nil {
+			break
+		}
+		client = ip
+	}
+	return client
+}
+
+// parseForwardedHop parses a hop from either header ("192.0.2.1", "\"[2001:db8::1]:4711\"", "192.0.2.1:80"), nil if it isn't an IP (ex. "unknown" or an obfuscated identifier)
+func parseForwardedHop(raw string) net.IP {
+	hop := strings.Trim(strings.TrimSpace(raw), `"`)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
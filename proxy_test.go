@@ -0,0 +1,57 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestForwardedClient(t *testing.T) {
+	trusted, err := ParseIPNets([]string{"10.0.0.0/24", "2001:db8:ffff::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		header  string // The header the proxies are configured with
+		headers map[string][]string
+		peer    string
+		want    string
+	}{
+		{"no header", "X-Forwarded-For", nil, "10.0.0.1", "10.0.0.1"},
+		{"untrusted peer", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "198.51.100.1", "198.51.100.1"},
+		{"trusted peer", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}}, "10.0.0.1", "192.0.2.1"},
+		{"trusted hops", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"192.0.2.1, 10.0.0.2", "10.0.0.3"}}, "10.0.0.1", "192.0.2.1"},
+		{"stops at untrusted hop", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"192.0.2.66, 198.51.100.1, 10.0.0.2"}}, "10.0.0.1", "198.51.100.1"},
+		{"invalid hop", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"192.0.2.1, garbage, 10.0.0.2"}}, "10.0.0.1", "10.0.0.2"},
+		{"IPv6 trusted peer", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8:ffff::1", "2001:db8::1"},
+		{"forwarded", "Forwarded", map[string][]string{"Forwarded": {`for=192.0.2.1;proto=https, for=10.0.0.2`}}, "10.0.0.1", "192.0.2.1"},
+		{"forwarded quoted IPv6", "Forwarded", map[string][]string{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "10.0.0.1", "2001:db8::1"},
+		{"forwarded case insensitive", "Forwarded", map[string][]string{"Forwarded": {`For=192.0.2.1`}}, "10.0.0.1", "192.0.2.1"},
+		{"forwarded stops at untrusted hop", "Forwarded", map[string][]string{"Forwarded": {`for=192.0.2.66, for=198.51.100.1`, `for=10.0.0.2`}}, "10.0.0.1", "198.51.100.1"},
+		{"forwarded obfuscated", "Forwarded", map[string][]string{"Forwarded": {`for=_hidden, for=10.0.0.2`}}, "10.0.0.1", "10.0.0.2"},
+		{"forwarded unknown", "Forwarded", map[string][]string{"Forwarded": {`for=unknown`}}, "10.0.0.1", "10.0.0.1"},
+		{"forwarded without for", "Forwarded", map[string][]string{"Forwarded": {`proto=https`}}, "10.0.0.1", "10.0.0.1"},
+		// The client sends the header the proxies don't set, which must not be believed
+		{"spoofed forwarded", "X-Forwarded-For", map[string][]string{"X-Forwarded-For": {"192.0.2.1"}, "Forwarded": {"for=192.0.2.66"}}, "10.0.0.1", "192.0.2.1"},
+		{"spoofed x-forwarded-for", "Forwarded", map[string][]string{"X-Forwarded-For": {"192.0.2.66"}, "Forwarded": {"for=192.0.2.1"}}, "10.0.0.1", "192.0.2.1"},
+		{"only the other header", "Forwarded", map[string][]string{"X-Forwarded-For": {"192.0.2.66"}}, "10.0.0.1", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		header := make(http.Header)
+		for name, values := range test.headers {
+			for _, value := range values {
+				header.Add(name, value)
+			}
+		}
+		client := forwardedClient(forwardedHops(header, test.header), net.ParseIP(test.peer), trusted)
+		if !client.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, client)
+		}
+	}
+}
@@ -20,26 +20,30 @@ type MultiRecordRebind struct {
 	v6Server *HTTPServer
 }
 
+// multiRecordRebindPoolRequirements declares how MultiRecordRebind leases from the pool, clients are blocked at the TCP layer so it
+// draws from public IPs the other methods don't use, spreading clients over the least leased ones
+// Untagged addresses are used when the "dedicated" pool has no eligible address
+var multiRecordRebindPoolRequirements = PoolRequirements{
+	Policy:   &PoolPolicyLeastLeased{},
+	Tag:      poolTagDedicated,
+	Fallback: true,
+}
+
 // NewMultiRecordRebind creates a *MultiRecordRebind instance, leasing servers as required
-func NewMultiRecordRebind(ctx context.Context, m *RebindManager, target *Address, ttl uint32) (r *MultiRecordRebind) {
+func NewMultiRecordRebind(ctx context.Context, m *RebindManager, target *Address, ports []string, ttl uint32) (r *MultiRecordRebind) {
 	r = &MultiRecordRebind{
 		target: target,
 		ttl:    ttl,
 	}
-	// If we can't parse out an IP, must be a CNAME rebind, we need 2 servers IPv4 and IPv6 since we don't know the family of the CNAME target
-	if target.IP() == nil {
-		r.v4Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: false}), target)
-		r.v6Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: true}), target)
-		// IPv6
-	} else if target.IP().To4() == nil {
-		r.v6Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: true}), target)
-		// IPv4
-	} else {
-		r.v4Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: false}), target)
-	}
+	r.v4Server, r.v6Server = m.LeaseHTTPServers(ctx, target, ports, multiRecordRebindPoolRequirements)
 	return
 }
 
+// Leased returns whether a server was leased for either family
+func (r *MultiRecordRebind) Leased() bool {
+	return r.v4Server != nil || r.v6Server != nil
+}
+
 // HandleDNS handles DNS requests
 func (r *MultiRecordRebind) HandleDNS(qType uint16) (ans []DNSAnswer) {
 	if qType == dns.TypeAAAA {
@@ -74,8 +78,13 @@ func (r *MultiRecordRebind) HandleDNS(qType uint16) (ans []DNSAnswer) {
 
 // HTTP Middleware implements the banning logic
 func (r *MultiRecordRebind) HTTPMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Debugf(r.URL.Path)
-		next.ServeHTTP(w, r)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log.Debugf(`MultiRecordRebind "%s" served "%s"`, rebindID(req.Context()), req.URL.Path)
+		next.ServeHTTP(w, req)
 	})
 }
+
+// ConnTermination resets connections so the browser gives up on our record and falls back to the target
+func (r *MultiRecordRebind) ConnTermination() ConnTermination {
+	return ConnTerminationReset
+}
@@ -21,27 +21,27 @@ type ThresholdRebind struct {
 	v6Server  *HTTPServer
 }
 
+// thresholdRebindPoolRequirements declares how ThresholdRebind leases from the pool, addresses are shared so keep each client on a few (with the configured policy)
+var thresholdRebindPoolRequirements = PoolRequirements{
+	Affinity: true,
+}
+
 // NewThresholdRebind creates a *ThresholdRebind instance, leasing servers as required
-func NewThresholdRebind(ctx context.Context, m *RebindManager, target *Address, threshold uint64, ttl uint32) (r *ThresholdRebind) {
+func NewThresholdRebind(ctx context.Context, m *RebindManager, target *Address, ports []string, threshold uint64, ttl uint32) (r *ThresholdRebind) {
 	r = &ThresholdRebind{
 		target:    target,
 		threshold: threshold,
 		ttl:       ttl,
 	}
-	// If we can't parse out an IP, must be a CNAME rebind, we need 2 servers IPv4 and IPv6 since we don't know the family of the CNAME target
-	if target.IP() == nil {
-		r.v4Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: false}), target)
-		r.v6Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: true}), target)
-		// IPv6
-	} else if target.IP().To4() == nil {
-		r.v6Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: true}), target)
-		// IPv4
-	} else {
-		r.v4Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: false}), target)
-	}
+	r.v4Server, r.v6Server = m.LeaseHTTPServers(ctx, target, ports, thresholdRebindPoolRequirements)
 	return
 }
 
+// Leased returns whether a server was leased for either family
+func (r *ThresholdRebind) Leased() bool {
+	return r.v4Server != nil || r.v6Server != nil
+}
+
 // HandleDNS handles DNS requests
 func (r *ThresholdRebind) HandleDNS(qType uint16) (ans []DNSAnswer) {
 	// If this is the first request, rebind on next
@@ -83,3 +83,8 @@ func (r *ThresholdRebind) HandleDNS(qType uint16) (ans []DNSAnswer) {
 func (r *ThresholdRebind) HTTPMiddleware(next http.Handler) http.Handler {
 	return next
 }
+
+// ConnTermination closes normally, every DNS lookup counts towards the threshold anyway
+func (r *ThresholdRebind) ConnTermination() ConnTermination {
+	return ConnTerminationClose
+}
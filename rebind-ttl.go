@@ -21,26 +21,26 @@ type TTLRebind struct {
 	v6Server *HTTPServer
 }
 
+// ttlRebindPoolRequirements declares how TTLRebind leases from the pool, addresses are shared so keep each client on a few (with the configured policy)
+var ttlRebindPoolRequirements = PoolRequirements{
+	Affinity: true,
+}
+
 // NewTTLRebind creates a *TTLRebind instance, leasing servers as required
-func NewTTLRebind(ctx context.Context, m *RebindManager, target *Address, ttl uint32) (r *TTLRebind) {
+func NewTTLRebind(ctx context.Context, m *RebindManager, target *Address, ports []string, ttl uint32) (r *TTLRebind) {
 	r = &TTLRebind{
 		target: target,
 		ttl:    ttl,
 	}
-	// If we can't parse out an IP, must be a CNAME rebind, we need 2 servers IPv4 and IPv6 since we don't know the family of the CNAME target
-	if target.IP() == nil {
-		r.v4Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: false}), target)
-		r.v6Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: true}), target)
-		// IPv6
-	} else if target.IP().To4() == nil {
-		r.v6Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: true}), target)
-		// IPv4
-	} else {
-		r.v4Server = m.GetHTTPServer(ctx, m.pool.Lease(ctx, &PoolCriteriaAddressFamily{IPv6: false}), target)
-	}
+	r.v4Server, r.v6Server = m.LeaseHTTPServers(ctx, target, ports, ttlRebindPoolRequirements)
 	return
 }
 
+// Leased returns whether a server was leased for either family
+func (r *TTLRebind) Leased() bool {
+	return r.v4Server != nil || r.v6Server != nil
+}
+
 // HandleDNS handles DNS requests
 func (r *TTLRebind) HandleDNS(qType uint16) (ans []DNSAnswer) {
 	// If this is the first request, rebind on next
@@ -82,3 +82,8 @@ func (r *TTLRebind) HandleDNS(qType uint16) (ans []DNSAnswer) {
 func (r *TTLRebind) HTTPMiddleware(next http.Handler) http.Handler {
 	return next
 }
+
+// ConnTermination waits for the browser to close its side, so it can't reuse the connection after the TTL expires
+func (r *TTLRebind) ConnTermination() ConnTermination {
+	return ConnTerminationGraceful
+}
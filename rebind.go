@@ -6,11 +6,126 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"syscall"
 )
 
 // RebindMethod describes a generic method for triggering a rebind
 type RebindMethod interface {
 	HandleDNS(uint16) []DNSAnswer
 	HTTPMiddleware(http.Handler) http.Handler
+	ConnTermination() ConnTermination
+	Leased() bool // Whether the method leased a server for either family, those that didn't have nothing to rebind to
+}
+
+// CanServe returns an error if no address in the pool can currently serve every one of the ports in the families the target needs
+// The addresses are checked against the criteria each of the requirements would lease with, any one of them being servable is enough
+func (m *RebindManager) CanServe(target *Address, ports []string, reqs ...PoolRequirements) error {
+	// CNAMEs can resolve to either family
+	v4 := target.IP() == nil || target.IP().To4() != nil
+	v6 := target.IP() == nil || target.IP().To4() == nil
+	available := func(r PoolRequirements, ipv6 bool) bool {
+		if m.pool.Available(m.poolCriteria(r, ports, ipv6, r.Tag)...) {
+			return true
+		}
+		return r.Tag != "" && r.Fallback && m.pool.Available(m.poolCriteria(r, ports, ipv6, "")...)
+	}
+	for _, r := range reqs {
+		if (v4 && available(r, false)) || (v6 && available(r, true)) {
+			return nil
+		}
+	}
+	return fmt.Errorf(`no address in the pool can serve port(s) %s for "%s"`, strings.Join(ports, ","), target)
+}
+
+// poolCriteria returns the criteria the requirements lease addresses of a family and named pool with, so they can serve every one of the ports
+func (m *RebindManager) poolCriteria(reqs PoolRequirements, ports []string, ipv6 bool, tag string) []PoolCriteria {
+	return reqs.With(append(m.pool.CriteriaPorts(ports), &PoolCriteriaAddressFamily{IPv6: ipv6}, &PoolCriteriaTag{Tag: tag})...)
+}
+
+// leaseHTTPServerAttempts is how many addresses are tried when the target port turns out to be in use
+const leaseHTTPServerAttempts = 4
+
+// LeaseHTTPServers leases the HTTP servers a rebind method needs to target an address, using the pool requirements declared by the method
+// Each leased address serves every one of the ports (the first being the target's), so they all rebind with the same DNS answers
+// The servers for the target's port are returned, either may be nil if the pool has no eligible address for that family and ports
+func (m *RebindManager) LeaseHTTPServers(ctx context.Context, target *Address, ports []string, reqs PoolRequirements) (v4Server *HTTPServer, v6Server *HTTPServer) {
+	// Methods that declare a policy keep it, the others use the configured one
+	policy := reqs.Policy
+	if policy == nil {
+		policy = m.poolPolicy
+	}
+	if reqs.Affinity && m.affinitySpread > 0 {
+		if policy == nil {
+			policy = &PoolPolicyLeastLeased{}
+		}
+		policy = &PoolPolicyAffinity{
+			Spread:   m.affinitySpread,
+			BySocket: m.affinityBySocket,
+			Fallback: policy,
+		}
+	}
+	leaseTagged := func(ipv6 bool, tag string) *HTTPServer {
+		criteria := m.poolCriteria(reqs, ports, ipv6, tag)
+	attempts:
+		for attempt := 0; attempt < leaseHTTPServerAttempts; attempt++ {
+			// Each attempt gets its own context so a conflicting address can be handed straight back (along with any servers already bound)
+			leaseCtx, release := context.WithCancel(ctx)
+			bind := m.pool.Lease(leaseCtx, policy, criteria...)
+			if bind == nil {
+				release()
+				return nil
+			}
+			var srv *HTTPServer
+			for _, port := range ports {
+				addr := target.Clone()
+				addr.Port = port
+				portSrv, err := m.GetHTTPServer(leaseCtx, bind, addr)
+				if err != nil {
+					log.Warnf(`Can't bind "%s" on port %s for request "%s" on socket "%s": %v`, bind, port, requestID(ctx), socketID(ctx), err)
+					// Something else owns the port (or we may not use it), other ports on the address are fine
+					if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EACCES) {
+						m.pool.MarkPortConflict(bind, port)
+					} else {
+						m.pool.MarkUnhealthy(bind, err)
+					}
+					release()
+					continue attempts
+				}
+				if srv == nil {
+					srv = portSrv
+				}
+			}
+			// Otherwise the lease lasts as long as the rebind
+			go func() {
+				<-ctx.Done()
+				release()
+			}()
+			return srv
+		}
+		return nil
+	}
+	lease := func(ipv6 bool) *HTTPServer {
+		if srv := leaseTagged(ipv6, reqs.Tag); srv != nil || reqs.Tag == "" || !reqs.Fallback {
+			return srv
+		}
+		log.Debugf(`No eligible address in the "%s" pool for request "%s" on socket "%s", falling back to untagged addresses`, reqs.Tag, requestID(ctx), socketID(ctx))
+		return leaseTagged(ipv6, "")
+	}
+	// If we can't parse out an IP, must be a CNAME rebind, we need 2 servers IPv4 and IPv6 since we don't know the family of the CNAME target
+	if target.IP() == nil {
+		v4Server = lease(false)
+		v6Server = lease(true)
+		// IPv6
+	} else if target.IP().To4() == nil {
+		v6Server = lease(true)
+		// IPv4
+	} else {
+		v4Server = lease(false)
+	}
+	return
 }
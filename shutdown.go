@@ -0,0 +1,53 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// WebSocketShutdownMessage tells a client the server is going away and its rebinds will be torn down
+type WebSocketShutdownMessage struct {
+	WebSocketEvent
+	Timeout float64 `json:"timeout"` // Seconds until the rebinds are torn down
+}
+
+// drainPollInterval is how often Drain checks whether every client has disconnected
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain tells every connected client the server is shutting down, then waits until they've all disconnected or the timeout passes
+// Rebinds keep working while draining, cancel the manager's context afterwards to tear them down
+func (m *RebindManager) Drain(timeout time.Duration) {
+	msg := &WebSocketShutdownMessage{
+		WebSocketEvent: WebSocketEvent{
+			Type:   webSocketTypeEvent,
+			Action: "shutdown",
+		},
+		Timeout: timeout.Seconds(),
+	}
+	m.SocketsLock.Lock()
+	sockets := make([]*webSocket, 0, len(m.Sockets))
+	for _, socket := range m.Sockets {
+		sockets = append(sockets, socket)
+	}
+	m.SocketsLock.Unlock()
+	log.Infof("Notifying %d socket(s) of the shutdown", len(sockets))
+	for _, socket := range sockets {
+		if err := socket.WriteJSON(msg); err != nil {
+			log.Warnf("Couldn't notify a socket of the shutdown: %v", err)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		m.SocketsLock.Lock()
+		remaining := len(m.Sockets)
+		m.SocketsLock.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
@@ -8,29 +8,88 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/satori/go.uuid"
 
 	"github.com/gorilla/websocket"
 )
 
+// The messages exchanged over the socket are documented in PROTOCOL.md, bump the version for any incompatible change
+
+// webSocketProtocol is the subprotocol clients have to ask for, it carries the version of the message schema
+const webSocketProtocol = "jaqen.v1"
+
+// Types of messages, set in every envelope
+const (
+	webSocketTypeRequest  = "request"  // From a client, answered by a response or an error with the same requestId
+	webSocketTypeResponse = "response" // The answer to a request
+	webSocketTypeEvent    = "event"    // Unsolicited, from the server (or relayed from another socket)
+	webSocketTypeError    = "error"    // A request failed
+)
+
 // upgrader is a global upgrader, because why not
 // TODO: Come up with a better reason other than "why not" or fix it
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{webSocketProtocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true // This is normally bad practice, but for this tool it's intentional
 	},
 }
 
-// WebSocketRequest is the
-type WebSocketRequest struct {
+// webSocket is a connected client, writes are serialized since a connection only supports one writer at a time
+type webSocket struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+// WriteJSON marshals v and writes it as a text message
+func (s *webSocket) WriteJSON(v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, raw)
+}
+
+// WebSocketEnvelope is the start of every request, response and error, the rest of the message depends on the action
+type WebSocketEnvelope struct {
+	Type      string    `json:"type"`
 	RequestID uuid.UUID `json:"requestId"`
 	Action    string    `json:"action"`
 }
 
+// WebSocketEvent is the start of every event, they aren't tied to a request
+type WebSocketEvent struct {
+	Type   string `json:"type"`
+	Action string `json:"action"`
+}
+
+// WebSocketError tells the client why one of its requests failed
+type WebSocketError struct {
+	WebSocketEnvelope
+	Error string `json:"error"`
+}
+
+// newWebSocketError creates the error reply to a request
+func newWebSocketError(req WebSocketEnvelope, err error) *WebSocketError {
+	return &WebSocketError{
+		WebSocketEnvelope: WebSocketEnvelope{
+			Type:      webSocketTypeError,
+			RequestID: req.RequestID,
+			Action:    req.Action,
+		},
+		Error: err.Error(),
+	}
+}
+
 // WebSocketInitRequest is the initial request
 type WebSocketInitRequest struct {
 	Navigator struct {
@@ -40,18 +99,27 @@ type WebSocketInitRequest struct {
 
 // WebSocketHostRequest is the request to offer rebinds for a given host
 type WebSocketHostRequest struct {
-	Host *Address `json:"host"`
+	Host  *Address   `json:"host"`
+	Ports []string   `json:"ports"` // Other ports of the host to rebind along with its own (optional)
+	Mode  RebindMode `json:"mode"`  // How the client will deliver the offers (optional, defaults to frames)
 }
 
-// WebSocketHostResponse is the request to offer rebinds for a given host
+// WebSocketHostResponse is the response with the rebinds offered for a given host
 type WebSocketHostResponse struct {
-	RequestID uuid.UUID     `json:"requestId"`
-	Offers    []RebindOffer `json:"offers"`
+	WebSocketEnvelope
+	Offers []RebindOffer `json:"offers"`
 }
 
-// WebSocketMessageHandler handles parsed messages from the socket, returns a list of waitgroups to decrement when the socket closes and any errors that occured
-func (m *RebindManager) WebSocketMessageHandler(ctx context.Context, conn *websocket.Conn, wReq WebSocketRequest, rawMsg []byte) error {
-	log.Infof(`Socket "%s" got msg "%s" for "%s" action`, socketID(ctx), requestID(ctx), wReq.Action)
+// WebSocketMessageHandler handles parsed messages from the socket, an error is sent back to the client as the reply to its request
+func (m *RebindManager) WebSocketMessageHandler(ctx context.Context, socket *webSocket, wReq WebSocketEnvelope, rawMsg []byte) error {
+	log.Infof(`Socket "%s" got %s "%s" for "%s" action`, socketID(ctx), wReq.Type, requestID(ctx), wReq.Action)
+	// The page of a navigation rebind answers the fetches relayed to it
+	if wReq.Type == webSocketTypeResponse && wReq.Action == "fetch" {
+		return m.relayFromNavigation(ctx, rawMsg, webSocketTypeResponse)
+	}
+	if wReq.Type != webSocketTypeRequest {
+		return fmt.Errorf(`unexpected "%s" message`, wReq.Type)
+	}
 	switch wReq.Action {
 	case "host":
 		// Parse the message
@@ -61,21 +129,45 @@ func (m *RebindManager) WebSocketMessageHandler(ctx context.Context, conn *webso
 		}
 		log.Debug(msg)
 		// Make rebind offers based on the information provided by the host
-		offers := m.MakeOffer(ctx, msg)
+		offers, err := m.MakeOffer(ctx, msg)
+		if err != nil {
+			return err
+		}
 		// Marshal into a response and write it back
 		resp := &WebSocketHostResponse{
-			RequestID: wReq.RequestID,
-			Offers:    offers,
+			WebSocketEnvelope: WebSocketEnvelope{
+				Type:      webSocketTypeResponse,
+				RequestID: wReq.RequestID,
+				Action:    wReq.Action,
+			},
+			Offers: offers,
 		}
-		rResp, err := json.Marshal(resp)
-		if err != nil {
+		if err := socket.WriteJSON(resp); err != nil {
 			return err
 		}
-		err = conn.WriteMessage(websocket.TextMessage, rResp)
-		if err != nil {
+		log.Infof(`Wrote (%d) offers (%s) to socket "%s" in response to msg "%s"`, len(offers), offers, socketID(ctx), requestID(ctx))
+	case "attach":
+		// The top-level page of a navigation rebind
+		var msg WebSocketNavigateMessage
+		if err := json.Unmarshal(rawMsg, &msg); err != nil {
 			return err
 		}
-		log.Infof(`Wrote (%d) offers (%s) to socket "%s" in response to msg "%s"`, len(offers), offers, socketID(ctx), requestID(ctx))
+		if err := m.attachNavigation(ctx, socket, msg.RebindID); err != nil {
+			return err
+		}
+		return socket.WriteJSON(&WebSocketEnvelope{
+			Type:      webSocketTypeResponse,
+			RequestID: wReq.RequestID,
+			Action:    wReq.Action,
+		})
+	case "fetch":
+		// From the client to the page of a navigation rebind, which answers it
+		return m.relayToNavigation(ctx, rawMsg)
+	case "ready":
+		// From the page of a navigation rebind, the client only needs to know
+		return m.relayFromNavigation(ctx, rawMsg, webSocketTypeEvent)
+	default:
+		return fmt.Errorf(`unknown action "%s"`, wReq.Action)
 	}
 	return nil
 }
@@ -85,8 +177,14 @@ func (m *RebindManager) WebSocketHandler(w http.ResponseWriter, req *http.Reques
 	// Upgrade to a websocket
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), 400)
+		log.Error(err) // The upgrader already replied
+		return
+	}
+	// Clients that don't speak our version can't be answered, the reason ends up in their close event
+	if conn.Subprotocol() != webSocketProtocol {
+		log.Warnf("Refusing socket from %s, it doesn't support the %s protocol", clientIP(req.Context()), webSocketProtocol)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol version, expected "+webSocketProtocol), time.Now().Add(time.Second))
+		conn.Close()
 		return
 	}
 	// Each socket has an ID
@@ -94,12 +192,26 @@ func (m *RebindManager) WebSocketHandler(w http.ResponseWriter, req *http.Reques
 	log.Infof(`New socket connection "%s"`, id)
 	// Create a cancel-able child context
 	ctx, triggerClose := context.WithCancel(req.Context())
-	ctx = context.WithValue(ctx, socketIDKey, id)
+	ctx = context.WithValue(ctx, socketIDKey, id) // The client's IP is already in there (see clientMiddleware)
+	// Track the socket so it can be told about shutdowns
+	socket := &webSocket{conn: conn}
+	m.SocketsLock.Lock()
+	m.Sockets[id] = socket
+	m.SocketsLock.Unlock()
 	// When the socket closes
 	defer func() {
 		log.Infof(`Socket "%s" has closed, cleaning up`, id)
+		m.SocketsLock.Lock()
+		delete(m.Sockets, id)
+		m.SocketsLock.Unlock()
+		m.detachNavigations(id)
 		triggerClose() // Cancel the context
 	}()
+	// Hijacked connections aren't closed by the server shutting down, do it ourselves
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 	// Loop reading messages in a queue
 	for {
 		// Read the init message
@@ -108,24 +220,25 @@ func (m *RebindManager) WebSocketHandler(w http.ResponseWriter, req *http.Reques
 			// Ignore 1001 (going away) "errors" as they are not errors really
 			if !websocket.IsCloseError(err, 1001) {
 				log.Error(err)
-				http.Error(w, err.Error(), 400)
 			}
 			return
 		}
-		// Read the request
-		var wReq WebSocketRequest
-		if err := json.Unmarshal(rawMsg, &wReq); err != nil {
-			log.Error(err)
-			http.Error(w, err.Error(), 400)
-			return
+		// Read the request, a malformed one still gets an error (without a requestId if that couldn't be read either)
+		var wReq WebSocketEnvelope
+		err = json.Unmarshal(rawMsg, &wReq)
+		if err == nil {
+			// Add the provided requestID to the context
+			ctx := context.WithValue(ctx, requestIDKey, wReq.RequestID)
+			// Handle it
+			err = m.WebSocketMessageHandler(ctx, socket, wReq, rawMsg)
 		}
-		// Add the provided requestID to the context
-		ctx := context.WithValue(ctx, requestIDKey, wReq.RequestID)
-		// Handle it
-		if err := m.WebSocketMessageHandler(ctx, conn, wReq, rawMsg); err != nil {
-			log.Error(err)
-			http.Error(w, err.Error(), 400)
-			return
+		// The socket stays open, only the request failed
+		if err != nil {
+			log.Warnf(`Socket "%s" msg "%s" for "%s" action failed: %v`, id, wReq.RequestID, wReq.Action, err)
+			if err := socket.WriteJSON(newWebSocketError(wReq, err)); err != nil {
+				log.Error(err)
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2017 LinkedIn Corporation. All rights reserved. Licensed under the BSD-2 Clause license.
+ * See LICENSE in the project root for license information.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TLS is only used for the loader host (v1.js and the WebSocket) so it can be included from HTTPS pages
+// Rebind frame servers on pool addresses always stay plain HTTP
+
+// LoadTLSConfig loads a single certificate and key, or every certificate in a directory (name.crt with name.key) selected by SNI
+func LoadTLSConfig(certFile, keyFile, certDir string) (*tls.Config, error) {
+	var certs []tls.Certificate
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if certDir != "" {
+		matches, err := filepath.Glob(filepath.Join(certDir, "*.crt"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			cert, err := tls.LoadX509KeyPair(match, strings.TrimSuffix(match, ".crt")+".key")
+			if err != nil {
+				return nil, fmt.Errorf(`couldn't load "%s": %v`, match, err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no TLS certificates were provided")
+	}
+	byName := make(map[string]*tls.Certificate)
+	for idx := range certs {
+		cert := &certs[idx]
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		// The first certificate to claim a name wins
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = cert
+			}
+		}
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+			if cert, ok := byName[name]; ok {
+				return cert, nil
+			}
+			// Try a wildcard for the parent domain
+			if idx := strings.Index(name, "."); idx != -1 {
+				if cert, ok := byName["*"+name[idx:]]; ok {
+					return cert, nil
+				}
+			}
+			// Clients without SNI (or unknown names) get the first certificate
+			return &certs[0], nil
+		},
+	}, nil
+}
+
+// ListenTLS starts a TLS listener serving the loader host on each of the binds, shutting them down when the context is cancelled
+// The binds are leased from the pool the same way the main HTTP binds are, an error is returned if any of them can't be
+func (m *RebindManager) ListenTLS(ctx context.Context, wg *sync.WaitGroup, binds []*Address, config *tls.Config) error {
+	for _, addr := range binds {
+		bind := m.pool.Lease(ctx, nil, &PoolCriteriaExternalIPMatch{Addr: addr}, m.pool.CriteriaPort(addr.Port))
+		if bind == nil {
+			return fmt.Errorf(`HTTPS bind address "%s" is not in the pool, is unhealthy or can't be bound to port %s`, addr, addr.Port)
+		}
+		bindAddr := bind.Clone()
+		bindAddr.Port = addr.Port
+		srv := &http.Server{
+			Addr:    bindAddr.InternalAddr(),
+			Handler: m.clientMiddleware(m.accessLogMiddleware(bindAddr, m.mainHandler(addr))),
+			// Inject the context into each request
+			BaseContext: func(net.Listener) context.Context {
+				return ctx
+			},
+		}
+		l, err := listenAddress(bindAddr)
+		if err != nil {
+			return fmt.Errorf(`couldn't start the HTTPS listener on "%s": %v`, bindAddr, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Infof(`Created HTTPS server bound to "%s"`, bindAddr)
+			if err := srv.Serve(tls.NewListener(m.proxyListener(l), config)); err != nil && err != http.ErrServerClosed {
+				log.Errorf(`HTTPS server bound to "%s" failed: %v`, bindAddr, err)
+			}
+			log.Infof(`Closed HTTPS server bound to "%s"`, bindAddr)
+		}()
+		go func() {
+			<-ctx.Done()
+			shutdownHTTPServer(srv)
+		}()
+	}
+	return nil
+}
